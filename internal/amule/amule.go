@@ -0,0 +1,185 @@
+package amule
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Pushes the port to aMule's TCP and UDP ports over External Connections (EC), the protocol amulecmd and amuleweb use
+type Client struct {
+	host string
+	port int
+	pass string
+	Log  logging.Logger
+}
+
+type portInfo struct {
+	TCPPort int
+	UDPPort int
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+}
+
+// pass is aMule's ECPassword in clear text, not its MD5 hash from amule.conf
+func NewClient(host string, port int, pass string, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "amule: "}
+	return &Client{
+		host: host,
+		port: port,
+		pass: pass,
+		Log:  logger,
+	}
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(c.host, strconv.Itoa(c.port)), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := c.login(conn); err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	c.Log.Debug("login OK")
+
+	info, err := c.getPortInfo(conn)
+	if err != nil {
+		return fmt.Errorf("getPortInfo failed: %s", err)
+	}
+	c.Log.Debug("getPortInfo okay portInfo=%v", info)
+
+	if info.TCPPort == port && info.UDPPort == port {
+		// nothing to do
+		c.Log.Info("Port is correct")
+		return nil
+	}
+
+	c.Log.Info("Pushing port %d, current port is %d", port, info.TCPPort)
+	res, err := c.request(conn, &packet{opcode: opSetPreferences, tags: []*tag{
+		parentTag(tagPrefsConnection,
+			uintTag(tagConnTCPPort, uint64(port)),
+			uintTag(tagConnUDPPort, uint64(port)),
+		),
+	}})
+	if err != nil {
+		return fmt.Errorf("push failed: %s", err)
+	}
+	if res.opcode != opNoop {
+		return fmt.Errorf("push failed, got opcode 0x%02x", res.opcode)
+	}
+	c.Log.Info("Port pushed")
+	return nil
+}
+
+// Salted password authentication of EC protocol version 2.4
+func (c *Client) login(conn net.Conn) error {
+	res, err := c.request(conn, &packet{opcode: opAuthReq, tags: []*tag{
+		stringTag(tagClientName, "Port Pusher"),
+		stringTag(tagClientVersion, "1.0"),
+		uintTag(tagProtocolVersion, protocolVersion),
+	}})
+	if err != nil {
+		return err
+	}
+	if res.opcode != opAuthSalt {
+		return fmt.Errorf("expected password salt, got opcode 0x%02x", res.opcode)
+	}
+	saltTag := res.tag(tagPasswdSalt)
+	if saltTag == nil {
+		return fmt.Errorf("password salt missing")
+	}
+	salt, err := saltTag.uint()
+	if err != nil {
+		return err
+	}
+
+	res, err = c.request(conn, &packet{opcode: opAuthPasswd, tags: []*tag{
+		hashTag(tagPasswdHash, saltedHash(c.pass, salt)),
+	}})
+	if err != nil {
+		return err
+	}
+	if res.opcode != opAuthOK {
+		return fmt.Errorf("password rejected")
+	}
+	return nil
+}
+
+// MD5(hex(MD5(password)) + hex(MD5(salt as uppercase hex))), see CRemoteConnect in aMule
+func saltedHash(pass string, salt uint64) []byte {
+	passHash := md5.Sum([]byte(pass))
+	saltHash := md5.Sum([]byte(fmt.Sprintf("%X", salt)))
+	sum := md5.Sum([]byte(hex.EncodeToString(passHash[:]) + hex.EncodeToString(saltHash[:])))
+	return sum[:]
+}
+
+func (c *Client) getPortInfo(conn net.Conn) (*portInfo, error) {
+	res, err := c.request(conn, &packet{opcode: opGetPreferences, tags: []*tag{
+		uintTag(tagSelectPrefs, prefsConnections),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if res.opcode != opSetPreferences {
+		return nil, fmt.Errorf("expected preferences, got opcode 0x%02x", res.opcode)
+	}
+	conns := res.tag(tagPrefsConnection)
+	if conns == nil {
+		return nil, fmt.Errorf("connection preferences missing")
+	}
+	info := &portInfo{}
+	for _, p := range []struct {
+		name uint16
+		port *int
+	}{{tagConnTCPPort, &info.TCPPort}, {tagConnUDPPort, &info.UDPPort}} {
+		t := conns.child(p.name)
+		if t == nil {
+			continue
+		}
+		v, err := t.uint()
+		if err != nil {
+			return nil, err
+		}
+		*p.port = int(v)
+	}
+	return info, nil
+}
+
+// Sends a packet and reads the response. EC_OP_AUTH_FAIL and EC_OP_FAILED become errors with aMule's message.
+func (c *Client) request(conn net.Conn, p *packet) (*packet, error) {
+	if err := writePacket(conn, p); err != nil {
+		return nil, err
+	}
+	res, err := readPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	if res.opcode == opAuthFail || res.opcode == opFailed {
+		msg := "no reason given"
+		if t := res.tag(tagString); t != nil {
+			msg = t.string()
+		}
+		return nil, fmt.Errorf("aMule refused: %s", msg)
+	}
+	return res, nil
+}
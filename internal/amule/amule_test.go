@@ -0,0 +1,225 @@
+package amule
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process aMule answering EC like its ExternalConn does
+type fakeAmule struct {
+	mu      sync.Mutex
+	pass    string
+	salt    uint64
+	tcpPort int
+	udpPort int
+	sets    int
+}
+
+func (f *fakeAmule) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (f *fakeAmule) handle(conn net.Conn) {
+	defer conn.Close()
+	authed := false
+	for {
+		req, err := readPacket(conn)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		res := f.reply(req, &authed)
+		f.mu.Unlock()
+		writePacket(conn, res)
+	}
+}
+
+func (f *fakeAmule) reply(req *packet, authed *bool) *packet {
+	fail := func(msg string) *packet {
+		return &packet{opcode: opAuthFail, tags: []*tag{stringTag(tagString, msg)}}
+	}
+	switch req.opcode {
+	case opAuthReq:
+		if v := req.tag(tagProtocolVersion); v == nil {
+			return fail("Missing protocol version tag.")
+		} else if n, _ := v.uint(); n != protocolVersion {
+			return fail("Invalid protocol version.")
+		}
+		return &packet{opcode: opAuthSalt, tags: []*tag{uintTag(tagPasswdSalt, f.salt)}}
+	case opAuthPasswd:
+		h := req.tag(tagPasswdHash)
+		if h == nil || !bytes.Equal(h.data, saltedHash(f.pass, f.salt)) {
+			return fail("Authentication failed.")
+		}
+		*authed = true
+		return &packet{opcode: opAuthOK, tags: []*tag{stringTag(0x0102, "2.3.3")}}
+	}
+	if !*authed {
+		return fail("Unauthorized")
+	}
+	switch req.opcode {
+	case opGetPreferences:
+		return &packet{opcode: opSetPreferences, tags: []*tag{parentTag(tagPrefsConnection,
+			uintTag(0x1301, 10000),
+			uintTag(tagConnTCPPort, uint64(f.tcpPort)),
+			uintTag(tagConnUDPPort, uint64(f.udpPort)),
+		)}}
+	case opSetPreferences:
+		if conns := req.tag(tagPrefsConnection); conns != nil {
+			if t := conns.child(tagConnTCPPort); t != nil {
+				v, _ := t.uint()
+				f.tcpPort = int(v)
+			}
+			if t := conns.child(tagConnUDPPort); t != nil {
+				v, _ := t.uint()
+				f.udpPort = int(v)
+			}
+		}
+		f.sets++
+		return &packet{opcode: opNoop}
+	}
+	return &packet{opcode: opFailed, tags: []*tag{stringTag(tagString, "Invalid request")}}
+}
+
+func newTestClient(t *testing.T, addr string, pass string) *Client {
+	host, port := testutil.HostPort(t, addr)
+	return NewClient(host, port, pass, logging.NewLogger(logging.ERROR))
+}
+
+func TestPush(t *testing.T) {
+	f := &fakeAmule{pass: "secret", salt: 0x1a2b3c4d5e6f, tcpPort: 4662, udpPort: 4672}
+	c := newTestClient(t, f.serve(t), "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	if f.tcpPort != 44201 || f.udpPort != 44201 {
+		t.Errorf("Expected TCP and UDP port 44201, got %d and %d", f.tcpPort, f.udpPort)
+	}
+	f.mu.Unlock()
+
+	// already set, nothing is changed
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sets != 1 {
+		t.Errorf("Expected a single preferences change, got %d", f.sets)
+	}
+}
+
+func TestPushUDPOnly(t *testing.T) {
+	f := &fakeAmule{pass: "secret", salt: 7, tcpPort: 44201, udpPort: 4672}
+	c := newTestClient(t, f.serve(t), "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.udpPort != 44201 {
+		t.Errorf("Expected UDP port 44201, got %d", f.udpPort)
+	}
+}
+
+func TestPushPasswordRejected(t *testing.T) {
+	f := &fakeAmule{pass: "secret", salt: 7}
+	c := newTestClient(t, f.serve(t), "wrong")
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error for rejected password")
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	in := &packet{opcode: opSetPreferences, tags: []*tag{
+		stringTag(tagClientName, "Port Pusher"),
+		uintTag(tagConnTCPPort, 200),
+		uintTag(tagConnUDPPort, 44201),
+		uintTag(tagSelectPrefs, 0x12345678),
+		uintTag(tagPasswdSalt, 0x123456789abc),
+		hashTag(tagPasswdHash, bytes.Repeat([]byte{0xab}, 16)),
+		parentTag(tagPrefsConnection,
+			uintTag(tagConnTCPPort, 44201),
+			parentTag(0x1400, stringTag(tagString, "nested")),
+		),
+	}}
+	out, err := readPacket(bytes.NewReader(encodePacket(in)))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if out.opcode != in.opcode || len(out.tags) != len(in.tags) {
+		t.Fatalf("Expected opcode 0x%02x with %d tags, got 0x%02x with %d", in.opcode, len(in.tags), out.opcode, len(out.tags))
+	}
+	if s := out.tag(tagClientName).string(); s != "Port Pusher" {
+		t.Errorf("Expected Port Pusher, got %q", s)
+	}
+	expectedTypes := []byte{typeString, typeUint8, typeUint16, typeUint32, typeUint64, typeHash16, typeCustom}
+	expectedInts := []uint64{0, 200, 44201, 0x12345678, 0x123456789abc}
+	for i, tg := range out.tags {
+		if tg.typ != expectedTypes[i] {
+			t.Errorf("Tag %d: expected type %d, got %d", i, expectedTypes[i], tg.typ)
+		}
+		if i > 0 && i < len(expectedInts) {
+			if v, err := tg.uint(); err != nil || v != expectedInts[i] {
+				t.Errorf("Tag %d: expected %d, got %d %v", i, expectedInts[i], v, err)
+			}
+		}
+	}
+	conns := out.tag(tagPrefsConnection)
+	if v, _ := conns.child(tagConnTCPPort).uint(); v != 44201 {
+		t.Errorf("Expected child TCP port 44201, got %d", v)
+	}
+	if s := conns.child(0x1400).child(tagString).string(); s != "nested" {
+		t.Errorf("Expected nested, got %q", s)
+	}
+}
+
+func TestEncodePacket(t *testing.T) {
+	got := encodePacket(&packet{opcode: opSetPreferences, tags: []*tag{
+		parentTag(tagPrefsConnection, uintTag(tagConnTCPPort, 44201)),
+	}})
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x20, // flags
+		0x00, 0x00, 0x00, 0x15, // payload length
+		0x40,       // opcode
+		0x00, 0x01, // tag count
+		0x26, 0x01, typeCustom, 0x00, 0x00, 0x00, 0x09, // 0x1300 with children, length
+		0x00, 0x01, // child count
+		0x26, 0x0c, typeUint16, 0x00, 0x00, 0x00, 0x02, 0xac, 0xa9, // 0x1306 = 44201
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected % x, got % x", expected, got)
+	}
+}
+
+func TestReadPacketRejectsCompressed(t *testing.T) {
+	data := encodePacket(&packet{opcode: opNoop})
+	data[3] |= flagZlib
+	if _, err := readPacket(bytes.NewReader(data)); err == nil {
+		t.Errorf("Expected error for a zlib packet")
+	}
+	data = encodePacket(&packet{opcode: opNoop})
+	data[7] = 0x10 // payload longer than the data
+	if _, err := readPacket(bytes.NewReader(data)); err == nil {
+		t.Errorf("Expected error for a truncated packet")
+	}
+}
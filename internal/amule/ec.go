@@ -0,0 +1,280 @@
+package amule
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// External Connections packet flags. Bit 5 is always set, see aMule's ECSocket.cpp.
+const (
+	flagBase        = 0x20
+	flagZlib        = 0x01
+	flagUTF8Numbers = 0x02
+	flagHasID       = 0x04
+	flagAccepts     = 0x10
+)
+
+// Opcodes, see aMule's ECCodes.h
+const (
+	opNoop           = 0x01
+	opAuthReq        = 0x02
+	opAuthFail       = 0x03
+	opAuthOK         = 0x04
+	opFailed         = 0x05
+	opGetPreferences = 0x3F
+	opSetPreferences = 0x40
+	opAuthSalt       = 0x4F
+	opAuthPasswd     = 0x50
+)
+
+// Tag names
+const (
+	tagString          = 0x0000
+	tagPasswdHash      = 0x0001
+	tagProtocolVersion = 0x0002
+	tagPasswdSalt      = 0x000B
+	tagClientName      = 0x0100
+	tagClientVersion   = 0x0101
+	tagSelectPrefs     = 0x1000
+	tagPrefsConnection = 0x1300
+	tagConnTCPPort     = 0x1306
+	tagConnUDPPort     = 0x1307
+)
+
+// Tag types
+const (
+	typeCustom = 1
+	typeUint8  = 2
+	typeUint16 = 3
+	typeUint32 = 4
+	typeUint64 = 5
+	typeString = 6
+	typeHash16 = 9
+)
+
+const (
+	protocolVersion   = 0x0204
+	prefsConnections  = 0x00000004
+	maxPacketSize     = 16 << 20
+	tagHeaderSize     = 2 + 1 + 4 // name, type, length
+	tagChildCountSize = 2
+)
+
+type tag struct {
+	name     uint16
+	typ      byte
+	data     []byte
+	children []*tag
+}
+
+type packet struct {
+	opcode byte
+	tags   []*tag
+}
+
+func stringTag(name uint16, s string) *tag {
+	return &tag{name: name, typ: typeString, data: append([]byte(s), 0)}
+}
+
+// Uses the smallest integer type that fits, like aMule does
+func uintTag(name uint16, v uint64) *tag {
+	switch {
+	case v <= 0xff:
+		return &tag{name: name, typ: typeUint8, data: []byte{byte(v)}}
+	case v <= 0xffff:
+		return &tag{name: name, typ: typeUint16, data: binary.BigEndian.AppendUint16(nil, uint16(v))}
+	case v <= 0xffffffff:
+		return &tag{name: name, typ: typeUint32, data: binary.BigEndian.AppendUint32(nil, uint32(v))}
+	}
+	return &tag{name: name, typ: typeUint64, data: binary.BigEndian.AppendUint64(nil, v)}
+}
+
+func hashTag(name uint16, hash []byte) *tag {
+	return &tag{name: name, typ: typeHash16, data: hash}
+}
+
+func parentTag(name uint16, children ...*tag) *tag {
+	return &tag{name: name, typ: typeCustom, children: children}
+}
+
+func (t *tag) uint() (uint64, error) {
+	switch {
+	case t.typ == typeUint8 && len(t.data) == 1:
+		return uint64(t.data[0]), nil
+	case t.typ == typeUint16 && len(t.data) == 2:
+		return uint64(binary.BigEndian.Uint16(t.data)), nil
+	case t.typ == typeUint32 && len(t.data) == 4:
+		return uint64(binary.BigEndian.Uint32(t.data)), nil
+	case t.typ == typeUint64 && len(t.data) == 8:
+		return binary.BigEndian.Uint64(t.data), nil
+	}
+	return 0, fmt.Errorf("tag 0x%04x is not an integer, type %d", t.name, t.typ)
+}
+
+func (t *tag) string() string {
+	return string(bytes.TrimRight(t.data, "\x00"))
+}
+
+func (t *tag) child(name uint16) *tag {
+	return findTag(t.children, name)
+}
+
+func (p *packet) tag(name uint16) *tag {
+	return findTag(p.tags, name)
+}
+
+func findTag(tags []*tag, name uint16) *tag {
+	for _, t := range tags {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Length of the data and children, the value of the tag's length field
+func (t *tag) length() uint32 {
+	n := uint32(len(t.data))
+	for _, c := range t.children {
+		n += tagHeaderSize + c.length()
+		if len(c.children) > 0 {
+			n += tagChildCountSize
+		}
+	}
+	return n
+}
+
+func writeTag(b *bytes.Buffer, t *tag) {
+	// the lowest bit of the name says whether child tags follow
+	name := t.name << 1
+	if len(t.children) > 0 {
+		name |= 1
+	}
+	b.Write(binary.BigEndian.AppendUint16(nil, name))
+	b.WriteByte(t.typ)
+	b.Write(binary.BigEndian.AppendUint32(nil, t.length()))
+	if len(t.children) > 0 {
+		b.Write(binary.BigEndian.AppendUint16(nil, uint16(len(t.children))))
+		for _, c := range t.children {
+			writeTag(b, c)
+		}
+	}
+	b.Write(t.data)
+}
+
+// Encodes a packet with its 8 byte header: flags and payload length
+func encodePacket(p *packet) []byte {
+	var payload bytes.Buffer
+	payload.WriteByte(p.opcode)
+	payload.Write(binary.BigEndian.AppendUint16(nil, uint16(len(p.tags))))
+	for _, t := range p.tags {
+		writeTag(&payload, t)
+	}
+	b := binary.BigEndian.AppendUint32(nil, flagBase)
+	b = binary.BigEndian.AppendUint32(b, uint32(payload.Len()))
+	return append(b, payload.Bytes()...)
+}
+
+func writePacket(w io.Writer, p *packet) error {
+	_, err := w.Write(encodePacket(p))
+	return err
+}
+
+// Reads one packet. Compressed and UTF-8 number packets aren't supported, aMule only sends them to clients that accept them.
+func readPacket(r io.Reader) (*packet, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	flags := binary.BigEndian.Uint32(header)
+	size := binary.BigEndian.Uint32(header[4:])
+	if flags&0xe0 != flagBase {
+		return nil, fmt.Errorf("invalid EC packet flags 0x%08x", flags)
+	}
+	if flags&(flagZlib|flagUTF8Numbers) != 0 {
+		return nil, fmt.Errorf("unsupported EC packet flags 0x%08x", flags)
+	}
+	if flags&flagAccepts != 0 {
+		if _, err := io.ReadFull(r, make([]byte, 4)); err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagHasID != 0 {
+		if _, err := io.ReadFull(r, make([]byte, 4)); err != nil {
+			return nil, err
+		}
+	}
+	if size > maxPacketSize {
+		return nil, fmt.Errorf("EC packet too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return decodePayload(payload)
+}
+
+func decodePayload(payload []byte) (*packet, error) {
+	r := bytes.NewReader(payload)
+	opcode, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.New("empty EC packet")
+	}
+	tags, err := readTags(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d bytes left after the EC packet's tags", r.Len())
+	}
+	return &packet{opcode: opcode, tags: tags}, nil
+}
+
+// Reads a tag count and that many tags
+func readTags(r *bytes.Reader) ([]*tag, error) {
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("truncated EC tag count")
+	}
+	tags := make([]*tag, 0, count)
+	for i := 0; i < int(count); i++ {
+		t, err := readTag(r)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+func readTag(r *bytes.Reader) (*tag, error) {
+	var header struct {
+		Name   uint16
+		Type   byte
+		Length uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("truncated EC tag")
+	}
+	t := &tag{name: header.Name >> 1, typ: header.Type}
+	dataLen := int64(header.Length)
+	if header.Name&1 != 0 {
+		start := r.Len()
+		children, err := readTags(r)
+		if err != nil {
+			return nil, err
+		}
+		t.children = children
+		// the child count isn't part of the length
+		dataLen -= int64(start-r.Len()) - tagChildCountSize
+	}
+	if dataLen < 0 || dataLen > int64(r.Len()) {
+		return nil, fmt.Errorf("EC tag 0x%04x has invalid length %d", t.name, header.Length)
+	}
+	t.data = make([]byte, dataLen)
+	r.Read(t.data)
+	return t, nil
+}
@@ -0,0 +1,199 @@
+package aria2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// The options kept in sync with the forwarded port
+var portOptions = []string{"listen-port", "dht-listen-port"}
+
+// Returned when aria2 accepts the new port but keeps the old one. aria2 only reads listen-port and
+// dht-listen-port at startup, it has to be restarted with the new port.
+var ErrRestartRequired = errors.New("restart required")
+
+// Pushes the port to aria2 over JSON-RPC, with HTTP (http:// and https:// URLs) or WebSocket (ws:// and wss:// URLs)
+type Client struct {
+	url    *url.URL
+	secret string
+	client *http.Client
+	Log    logging.Logger
+	nextID int
+	asked  int // port aria2 was asked to restart with, reported once
+}
+
+// Returned when aria2 answers with a JSON-RPC error, e.g. code 1 "Unauthorized" for a wrong secret
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("aria2 error %d: %s", e.Code, e.Message)
+}
+
+type request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      string        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type response struct {
+	ID     string          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// Stringer
+func (c *Client) String() string {
+	secret := "none"
+	if c.secret != "" {
+		secret = "token"
+	}
+	return fmt.Sprintf("url=%s secret=%s", c.url.Redacted(), secret)
+}
+
+// secret is aria2's --rpc-secret, empty when it isn't set
+func NewClient(rpcURL *url.URL, secret string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "aria2: "}
+	return &Client{
+		url:    rpcURL,
+		secret: secret,
+		client: httpClient,
+		Log:    logger,
+	}
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	var options map[string]string
+	if err := c.call("aria2.getGlobalOption", &options); err != nil {
+		return fmt.Errorf("getGlobalOption failed: %w", err)
+	}
+	c.Log.Debug("getGlobalOption okay listen-port=%s dht-listen-port=%s", options["listen-port"], options["dht-listen-port"])
+
+	want := strconv.Itoa(port)
+	changes := map[string]string{}
+	for _, name := range portOptions {
+		if options[name] != want {
+			changes[name] = want
+		}
+	}
+	if len(changes) == 0 {
+		c.Log.Info("Port is correct")
+		return nil
+	}
+
+	if c.asked == port {
+		c.Log.Warn("Waiting for a restart of aria2 with --listen-port=%d --dht-listen-port=%d", port, port)
+		return nil
+	}
+
+	c.Log.Info("Pushing port %d, current port is %s", port, options["listen-port"])
+	var result string
+	if err := c.call("aria2.changeGlobalOption", &result, changes); err != nil {
+		return fmt.Errorf("push failed: %w", err)
+	}
+	if result != "OK" {
+		return fmt.Errorf("push failed, aria2 answered %q", result)
+	}
+
+	// aria2 can answer OK without applying an option, read them back to be sure
+	if err := c.call("aria2.getGlobalOption", &options); err != nil {
+		return fmt.Errorf("getGlobalOption failed: %w", err)
+	}
+	for _, name := range portOptions {
+		if options[name] != want {
+			c.asked = port
+			return fmt.Errorf("%w, %s is still %s, set it to %d in aria2.conf and restart aria2", ErrRestartRequired, name, options[name], port)
+		}
+	}
+	c.asked = 0
+	c.Log.Info("Port pushed")
+	return nil
+}
+
+// Calls a JSON-RPC method with the secret token as the first param and decodes the result into v
+func (c *Client) call(method string, v interface{}, params ...interface{}) error {
+	c.nextID++
+	req := request{
+		JSONRPC: "2.0",
+		ID:      fmt.Sprintf("portpusher-%d", c.nextID),
+		Method:  method,
+		Params:  make([]interface{}, 0, len(params)+1),
+	}
+	if c.secret != "" {
+		req.Params = append(req.Params, "token:"+c.secret)
+	}
+	req.Params = append(req.Params, params...)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request %s", err)
+	}
+
+	var data []byte
+	switch c.url.Scheme {
+	case "ws", "wss":
+		data, err = c.postWebSocket(body, req.ID)
+	default:
+		data, err = c.postHTTP(body)
+	}
+	if err != nil {
+		return err
+	}
+	c.Log.Debug("%s response=%s", method, string(data))
+
+	var res response
+	if err := json.Unmarshal(data, &res); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %s", err)
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	if err := json.Unmarshal(res.Result, v); err != nil {
+		return fmt.Errorf("failed to unmarshal result: %s", err)
+	}
+	return nil
+}
+
+func (c *Client) postHTTP(body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response %s", err)
+	}
+	// aria2 answers JSON-RPC errors with HTTP 400 and a JSON body
+	if res.StatusCode != http.StatusOK && !json.Valid(data) {
+		return nil, fmt.Errorf("HTTP request error, got Http %d", res.StatusCode)
+	}
+	return data, nil
+}
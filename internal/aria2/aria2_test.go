@@ -0,0 +1,206 @@
+package aria2
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// In-process aria2 that answers JSON-RPC over HTTP and WebSocket
+type fakeAria2 struct {
+	mu            sync.Mutex
+	options       map[string]string
+	ignoreChanges bool
+	calls         []string
+}
+
+func (f *fakeAria2) handle(body []byte) []byte {
+	var req struct {
+		ID     string            `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	res := map[string]interface{}{"jsonrpc": "2.0"}
+	if err := json.Unmarshal(body, &req); err != nil {
+		res["error"] = map[string]interface{}{"code": -32700, "message": "Parse error."}
+		data, _ := json.Marshal(res)
+		return data
+	}
+	res["id"] = req.ID
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, req.Method)
+	var token string
+	if len(req.Params) > 0 {
+		json.Unmarshal(req.Params[0], &token)
+	}
+	switch {
+	case token != "token:secret":
+		res["error"] = map[string]interface{}{"code": 1, "message": "Unauthorized"}
+	case req.Method == "aria2.getGlobalOption":
+		res["result"] = f.options
+	case req.Method == "aria2.changeGlobalOption" && len(req.Params) == 2:
+		var changes map[string]string
+		json.Unmarshal(req.Params[1], &changes)
+		if !f.ignoreChanges {
+			for k, v := range changes {
+				f.options[k] = v
+			}
+		}
+		res["result"] = "OK"
+	default:
+		res["error"] = map[string]interface{}{"code": 1, "message": "No such method: " + req.Method}
+	}
+	data, _ := json.Marshal(res)
+	return data
+}
+
+func (f *fakeAria2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") == "websocket" {
+		f.serveWebSocket(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json-rpc")
+	w.Write(f.handle(body))
+}
+
+// Upgrades the connection, sends a notification first like aria2 does for download events, then answers
+func (f *fakeAria2) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + acceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	brw.Flush()
+
+	_, opcode, body, err := readFrame(brw)
+	if err != nil || opcode != opText {
+		return
+	}
+	writeFrame(conn, opPing, []byte("hi"), false)
+	writeFrame(conn, opText, []byte(`{"jsonrpc":"2.0","method":"aria2.onDownloadStart","params":[{"gid":"2089b05ecca3d829"}]}`), false)
+	res := f.handle(body)
+	// split the response over a continuation frame
+	conn.Write(append([]byte{opText, byte(10)}, res[:10]...))
+	writeFrame(conn, opContinuation, res[10:], false)
+	readFrame(brw) // pong
+	readFrame(brw) // close
+}
+
+func newTestClient(rawURL string, secret string) *Client {
+	u, _ := url.Parse(rawURL)
+	return NewClient(u, secret, http.DefaultClient, logging.NewLogger(logging.ERROR))
+}
+
+func TestPushHTTP(t *testing.T) {
+	f := &fakeAria2{options: map[string]string{"listen-port": "6881-6999", "dht-listen-port": "6881-6999"}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(server.URL+"/jsonrpc", "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.options["listen-port"] != "44201" || f.options["dht-listen-port"] != "44201" {
+		t.Errorf("Expected both ports 44201, got %v", f.options)
+	}
+
+	// already set, nothing is changed
+	f.calls = nil
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(f.calls) != 1 {
+		t.Errorf("Expected only the read, got %v", f.calls)
+	}
+}
+
+func TestPushDHTOnly(t *testing.T) {
+	f := &fakeAria2{options: map[string]string{"listen-port": "44201", "dht-listen-port": "6881-6999"}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(server.URL+"/jsonrpc", "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.options["dht-listen-port"] != "44201" {
+		t.Errorf("Expected dht-listen-port 44201, got %v", f.options)
+	}
+}
+
+func TestPushNotApplied(t *testing.T) {
+	f := &fakeAria2{options: map[string]string{"listen-port": "6881-6999", "dht-listen-port": "6881-6999"}, ignoreChanges: true}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(server.URL+"/jsonrpc", "secret")
+	if err := c.Push(44201); !errors.Is(err, ErrRestartRequired) {
+		t.Errorf("Expected ErrRestartRequired when aria2 doesn't apply the port, got %v", err)
+	}
+
+	// reported once, then waits for the restart without asking again
+	f.calls = nil
+	if err := c.Push(44201); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	if len(f.calls) != 1 {
+		t.Errorf("Expected only the read, got %v", f.calls)
+	}
+
+	// a new port is pushed again
+	if err := c.Push(44202); !errors.Is(err, ErrRestartRequired) {
+		t.Errorf("Expected ErrRestartRequired for a new port, got %v", err)
+	}
+
+	// restarted with the new port
+	f.options["listen-port"] = "44202"
+	f.options["dht-listen-port"] = "44202"
+	f.calls = nil
+	if err := c.Push(44202); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	if len(f.calls) != 1 {
+		t.Errorf("Expected only the read, got %v", f.calls)
+	}
+}
+
+func TestPushUnauthorized(t *testing.T) {
+	server := httptest.NewServer(&fakeAria2{options: map[string]string{}})
+	defer server.Close()
+
+	c := newTestClient(server.URL+"/jsonrpc", "wrong")
+	err := c.Push(44201)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != 1 {
+		t.Errorf("Expected RPC error 1, got %v", err)
+	}
+}
+
+func TestPushWebSocket(t *testing.T) {
+	f := &fakeAria2{options: map[string]string{"listen-port": "6881-6999", "dht-listen-port": "6881-6999"}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient("ws://"+strings.TrimPrefix(server.URL, "http://")+"/jsonrpc", "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.options["listen-port"] != "44201" || f.options["dht-listen-port"] != "44201" {
+		t.Errorf("Expected both ports 44201, got %v", f.options)
+	}
+}
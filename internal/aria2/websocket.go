@@ -0,0 +1,233 @@
+package aria2
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WebSocket (RFC 6455) opcodes
+const (
+	opContinuation = 0
+	opText         = 1
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// Appended to the client key to compute Sec-WebSocket-Accept
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Sends one JSON-RPC request over a WebSocket and waits for the response with the same id.
+// aria2 also sends notifications like aria2.onDownloadStart over the socket, those are skipped.
+func (c *Client) postWebSocket(body []byte, id string) ([]byte, error) {
+	conn, br, err := dialWebSocket(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := writeFrame(conn, opText, body, true); err != nil {
+		return nil, err
+	}
+	for {
+		data, err := readMessage(br, conn)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(data, &res) == nil && res.ID == id {
+			writeFrame(conn, opClose, []byte{0x03, 0xe8}, true) // 1000, normal closure
+			return data, nil
+		}
+		c.Log.Debug("skipping websocket message %s", string(data))
+	}
+}
+
+// Opens a WebSocket connection to a ws:// or wss:// URL
+func dialWebSocket(u *url.URL) (net.Conn, *bufio.Reader, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "wss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	httpURL := *u
+	httpURL.Scheme = "http"
+	req, err := http.NewRequest(http.MethodGet, httpURL.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Add("User-Agent", "Port Pusher")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("websocket handshake failed: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, nil, fmt.Errorf("websocket handshake failed, got HTTP %d", res.StatusCode)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, nil, errors.New("websocket handshake failed, bad Sec-WebSocket-Accept")
+	}
+	return conn, br, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Writes a single final frame. Clients must mask their frames, servers must not.
+func writeFrame(w io.Writer, opcode byte, payload []byte, mask bool) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if mask {
+		header[1] |= 0x80
+		key := make([]byte, 4)
+		rand.Read(key)
+		header = append(header, key...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ key[i%4]
+		}
+		payload = masked
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Reads one frame, unmasking it when needed
+func readFrame(r io.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext)
+	}
+	if n > 16<<20 {
+		err = fmt.Errorf("websocket frame too large: %d bytes", n)
+		return
+	}
+	var key []byte
+	if masked {
+		key = make([]byte, 4)
+		if _, err = io.ReadFull(r, key); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return
+}
+
+// Reads frames until a whole text message arrived, answering pings on the way
+func readMessage(r io.Reader, w io.Writer) ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := readFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case opPing:
+			if err := writeFrame(w, opPong, payload, true); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return nil, errors.New("websocket closed by server")
+		case opText, opContinuation:
+			message = append(message, payload...)
+		default:
+			return nil, fmt.Errorf("unexpected websocket opcode %d", opcode)
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
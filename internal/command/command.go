@@ -0,0 +1,109 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/ports"
+)
+
+// Gets the forwarded port by running a command (natpmpc, a vendor CLI, a script, ...) and parsing its stdout.
+type Client struct {
+	command string
+	timeout time.Duration
+	format  string
+	parse   ports.Parser
+	Log     logging.Logger
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("command=%q timeout=%v format=%s", c.command, c.timeout, c.format)
+}
+
+// format only describes the parser in logs
+func NewClient(command string, timeout time.Duration, format string, parse ports.Parser, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "exec: "}
+	return &Client{
+		command: command,
+		timeout: timeout,
+		format:  format,
+		parse:   parse,
+		Log:     logger,
+	}
+}
+
+// Pull the forwarded ports from the command's output.
+// A non-zero exit status or a timeout is an error.
+func (c *Client) PullPorts() ([]int, error) {
+	ports, err := c.doPullPorts()
+	if err != nil {
+		c.Log.Error("pull port error: %v", err)
+		return nil, err
+	}
+	return ports, nil
+}
+
+func (c *Client) doPullPorts() ([]int, error) {
+	stdout, err := Run(c.command, c.timeout, c.Log)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := c.parse(stdout)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse output: %w", err)
+	}
+
+	if len(ports) == 1 {
+		c.Log.Info("Forwarded port is %d", ports[0])
+	} else {
+		c.Log.Info("Forwarded ports are %v", ports)
+	}
+	return ports, nil
+}
+
+// Runs a command with /bin/sh -c and returns its stdout.
+// stderr goes to the logger: Debug when the command succeeds, Warn when it fails.
+func Run(command string, timeout time.Duration, logger logging.Logger) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// don't wait on children that keep stdout open after the shell is killed
+	cmd.WaitDelay = time.Second
+
+	logger.Debug("running %s", command)
+	err := cmd.Run()
+
+	log := logger.Debug
+	if err != nil {
+		log = logger.Warn
+	}
+	for _, line := range strings.Split(strings.TrimRight(stderr.String(), "\n"), "\n") {
+		if line != "" {
+			log("stderr: %s", line)
+		}
+	}
+	logger.Debug("stdout: %s", stdout.String())
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("command timed out after %v", timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("command exited with status %d", exitErr.ExitCode())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not run command: %s", err)
+	}
+	return stdout.Bytes(), nil
+}
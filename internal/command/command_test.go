@@ -0,0 +1,76 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/ports"
+)
+
+// Remembers what was logged
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.record("debug", msg, args...) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.record("info", msg, args...) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.record("warn", msg, args...) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.record("error", msg, args...) }
+func (l *recordingLogger) record(level string, msg string, args ...any) {
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(msg, args...))
+}
+
+func (l *recordingLogger) contains(s string) bool {
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPullPorts(t *testing.T) {
+	parse, err := ports.RegexParser(`Mapped public port (\d+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &recordingLogger{}
+	c := NewClient(`echo "Mapped public port 44201 protocol UDP to local port 0 lifetime 60"; echo "gateway ok" >&2`, time.Second, "regex", parse, logger)
+
+	forwarded, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(forwarded) != 1 || forwarded[0] != 44201 {
+		t.Errorf("Expected [44201], got %v", forwarded)
+	}
+	if !logger.contains("debug exec: stderr: gateway ok") {
+		t.Errorf("Expected stderr in the debug log, got %v", logger.lines)
+	}
+}
+
+func TestPullPortsExitStatus(t *testing.T) {
+	logger := &recordingLogger{}
+	c := NewClient(`echo 44201; echo "no gateway" >&2; exit 3`, time.Second, "int", ports.IntParser(), logger)
+	_, err := c.PullPorts()
+	if err == nil || !strings.Contains(err.Error(), "status 3") {
+		t.Errorf("Expected exit status error, got %v", err)
+	}
+	if !logger.contains("warn exec: stderr: no gateway") {
+		t.Errorf("Expected stderr in the warn log, got %v", logger.lines)
+	}
+}
+
+func TestPullPortsTimeout(t *testing.T) {
+	c := NewClient(`sleep 5; echo 44201`, 100*time.Millisecond, "int", ports.IntParser(), &recordingLogger{})
+	start := time.Now()
+	_, err := c.PullPorts()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("Expected the command to be killed, took %v", time.Since(start))
+	}
+}
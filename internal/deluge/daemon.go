@@ -0,0 +1,184 @@
+package deluge
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Deluge 2 daemon RPC message types
+const (
+	rpcResponse = 1
+	rpcError    = 2
+	rpcEvent    = 3
+)
+
+// Deluge 2 prefixes every message with this version and the body length
+const protocolVersion = 1
+
+// Sent with daemon.login, deluged refuses clients that don't say which version they are
+const clientVersion = "2.1.1"
+
+// Returned when deluged answers a call with an exception
+type RPCError struct {
+	Type    string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+func (c *Client) doPushDaemon(port int) error {
+	conn, err := c.dialDaemon()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := c.daemonCall(conn, "daemon.login", []interface{}{c.user, c.pass}, map[string]interface{}{"client_version": clientVersion}); err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	c.Log.Debug("login OK")
+
+	listenPorts, err := c.daemonCall(conn, "core.get_config_value", []interface{}{"listen_ports"}, nil)
+	if err != nil {
+		return fmt.Errorf("get listen_ports failed: %w", err)
+	}
+	randomPort, err := c.daemonCall(conn, "core.get_config_value", []interface{}{"random_port"}, nil)
+	if err != nil {
+		return fmt.Errorf("get random_port failed: %w", err)
+	}
+	c.Log.Debug("getConfig OK listen_ports=%v random_port=%v", listenPorts, randomPort)
+
+	ports, ok := listenPorts.([]interface{})
+	if !ok || len(ports) == 0 {
+		return fmt.Errorf("expected listen ports but found %T %v", listenPorts, listenPorts)
+	}
+	current, _ := ports[0].(int64)
+
+	if int(current) == port && randomPort == false {
+		c.Log.Info("Port is correct")
+		return nil
+	}
+
+	c.Log.Info("Pushing port %d, current port is %d", port, current)
+	config := map[string]interface{}{
+		"listen_ports": []int{port, port},
+		"random_port":  false,
+	}
+	if _, err := c.daemonCall(conn, "core.set_config", []interface{}{config}, nil); err != nil {
+		return fmt.Errorf("push failed: %w", err)
+	}
+	c.Log.Info("Port pushed")
+	return nil
+}
+
+// deluged only speaks TLS, with a self-signed certificate it generates on first start
+func (c *Client) dialDaemon() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(c.host, strconv.Itoa(c.port)), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return conn, nil
+}
+
+// Calls a daemon method and returns its result, skipping any events deluged sends in between
+func (c *Client) daemonCall(conn net.Conn, method string, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	id := c.nextId()
+	if kwargs == nil {
+		kwargs = map[string]interface{}{}
+	}
+	// a list of requests, each one [id, method, args, kwargs]
+	req := []interface{}{[]interface{}{id, method, args, kwargs}}
+	c.Log.Debug("%s request id=%d", method, id)
+	if err := writeDaemonMessage(conn, req); err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := readDaemonMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		res, ok := msg.([]interface{})
+		if !ok || len(res) < 2 {
+			return nil, fmt.Errorf("unexpected daemon message %v", msg)
+		}
+		switch res[0] {
+		case int64(rpcEvent):
+			c.Log.Debug("skipping event %v", res[1])
+			continue
+		case int64(rpcResponse):
+			if res[1] != int64(id) || len(res) < 3 {
+				return nil, fmt.Errorf("unexpected response %v", res)
+			}
+			return res[2], nil
+		case int64(rpcError):
+			// [RPC_ERROR, id, exception type, exception args, exception kwargs, traceback]
+			rpcErr := &RPCError{Type: "Error"}
+			if len(res) > 2 {
+				rpcErr.Type = fmt.Sprint(res[2])
+			}
+			if len(res) > 3 {
+				if args, ok := res[3].([]interface{}); ok && len(args) > 0 {
+					rpcErr.Message = fmt.Sprint(args[0])
+				}
+			}
+			return nil, rpcErr
+		}
+		return nil, fmt.Errorf("unexpected daemon message type %v", res[0])
+	}
+}
+
+// A message is a version byte, the body length and the zlib compressed rencoded body
+func writeDaemonMessage(w io.Writer, v interface{}) error {
+	data, err := rencode(v)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	zw := zlib.NewWriter(&body)
+	zw.Write(data)
+	zw.Close()
+
+	header := []byte{protocolVersion}
+	header = binary.BigEndian.AppendUint32(header, uint32(body.Len()))
+	_, err = w.Write(append(header, body.Bytes()...))
+	return err
+}
+
+func readDaemonMessage(r io.Reader) (interface{}, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != protocolVersion {
+		return nil, fmt.Errorf("unsupported daemon protocol version %d, Deluge 2 is required", header[0])
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > 16<<20 {
+		return nil, fmt.Errorf("daemon message too large: %d bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress daemon message: %s", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress daemon message: %s", err)
+	}
+	return rdecode(data)
+}
@@ -0,0 +1,234 @@
+package deluge
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process deluged with a self-signed certificate like the one it generates
+type fakeDeluged struct {
+	mu          sync.Mutex
+	listenPorts []interface{}
+	randomPort  bool
+	sets        int
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (f *fakeDeluged) serve(t *testing.T) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (f *fakeDeluged) handle(conn net.Conn) {
+	defer conn.Close()
+	authed := false
+	for {
+		msg, err := readDaemonMessage(conn)
+		if err != nil {
+			return
+		}
+		req := msg.([]interface{})[0].([]interface{})
+		id, method, args, kwargs := req[0], req[1].(string), req[2].([]interface{}), req[3].(map[string]interface{})
+
+		// an event first, clients must skip it
+		writeDaemonMessage(conn, []interface{}{rpcEvent, "SessionPausedEvent", []interface{}{}})
+
+		f.mu.Lock()
+		result, errType, errMsg := f.dispatch(method, args, kwargs, &authed)
+		f.mu.Unlock()
+		if errType != "" {
+			writeDaemonMessage(conn, []interface{}{rpcError, id, errType, []interface{}{errMsg}, map[string]interface{}{}, "Traceback"})
+		} else {
+			writeDaemonMessage(conn, []interface{}{rpcResponse, id, result})
+		}
+	}
+}
+
+func (f *fakeDeluged) dispatch(method string, args []interface{}, kwargs map[string]interface{}, authed *bool) (interface{}, string, string) {
+	if method == "daemon.login" {
+		if _, ok := kwargs["client_version"]; !ok {
+			return nil, "IncompatibleClient", "Your deluge client is not compatible with the daemon."
+		}
+		if len(args) != 2 || args[0] != "portpusher" || args[1] != "secret" {
+			return nil, "BadLoginError", "Password does not match"
+		}
+		*authed = true
+		return int64(10), "", ""
+	}
+	if !*authed {
+		return nil, "NotAuthorizedError", "Auth level too low: 0 < 1"
+	}
+	switch method {
+	case "core.get_config_value":
+		switch args[0] {
+		case "listen_ports":
+			return f.listenPorts, "", ""
+		case "random_port":
+			return f.randomPort, "", ""
+		}
+		return nil, "", ""
+	case "core.set_config":
+		config := args[0].(map[string]interface{})
+		if v, ok := config["listen_ports"]; ok {
+			f.listenPorts = v.([]interface{})
+		}
+		if v, ok := config["random_port"]; ok {
+			f.randomPort = v.(bool)
+		}
+		f.sets++
+		return nil, "", ""
+	}
+	return nil, "WrappedException", "Unknown method " + method
+}
+
+func newDaemonTestClient(t *testing.T, addr string, user string, pass string) *Client {
+	host, port := testutil.HostPort(t, addr)
+	return NewDaemonClient(host, port, user, pass, logging.NewLogger(logging.ERROR))
+}
+
+func TestPushDaemon(t *testing.T) {
+	f := &fakeDeluged{listenPorts: []interface{}{int64(6881), int64(6891)}, randomPort: true}
+	c := newDaemonTestClient(t, f.serve(t), "portpusher", "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	if !reflect.DeepEqual(f.listenPorts, []interface{}{int64(44201), int64(44201)}) || f.randomPort {
+		t.Errorf("Expected listen ports 44201 without random, got %v random=%v", f.listenPorts, f.randomPort)
+	}
+	f.mu.Unlock()
+
+	// already set, nothing is changed
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sets != 1 {
+		t.Errorf("Expected a single config change, got %d", f.sets)
+	}
+}
+
+func TestPushDaemonLoginRejected(t *testing.T) {
+	f := &fakeDeluged{listenPorts: []interface{}{int64(6881), int64(6891)}}
+	c := newDaemonTestClient(t, f.serve(t), "portpusher", "wrong")
+	err := c.Push(44201)
+	if err == nil || !strings.Contains(err.Error(), "BadLoginError") {
+		t.Errorf("Expected BadLoginError, got %v", err)
+	}
+}
+
+func TestRencodeRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	longList := make([]interface{}, 70)
+	for i := range longList {
+		longList[i] = int64(i)
+	}
+	longDict := map[string]interface{}{}
+	for i := 0; i < 30; i++ {
+		longDict[strconv.Itoa(i)] = int64(i)
+	}
+	values := []interface{}{
+		nil, true, false,
+		int64(0), int64(43), int64(44), int64(-1), int64(-32), int64(-33), int64(127), int64(-128),
+		int64(44201), int64(-32768), int64(1 << 20), int64(-1 << 31), int64(1 << 40),
+		1.5, "", "listen_ports", long,
+		[]interface{}{int64(6881), int64(6891)}, longList,
+		map[string]interface{}{"random_port": false, "listen_ports": []interface{}{int64(1), int64(2)}}, longDict,
+	}
+	for _, v := range values {
+		data, err := rencode(v)
+		if err != nil {
+			t.Fatalf("%v: got error %v", v, err)
+		}
+		got, err := rdecode(data)
+		if err != nil {
+			t.Fatalf("%v: got error %v", v, err)
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("Expected %v, got %v", v, got)
+		}
+	}
+}
+
+func TestRencode(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{int64(5), []byte{5}},
+		{int64(-1), []byte{70}},
+		{int64(100), []byte{rencodeInt1, 100}},
+		{int64(44201), []byte{rencodeInt4, 0x00, 0x00, 0xac, 0xa9}},
+		{"abc", []byte{128 + 3, 'a', 'b', 'c'}},
+		{[]interface{}{int64(1), "a"}, []byte{192 + 2, 1, 128 + 1, 'a'}},
+		{map[string]interface{}{"a": true}, []byte{102 + 1, 128 + 1, 'a', rencodeTrue}},
+		{[]interface{}{}, []byte{192}},
+	}
+	for _, test := range tests {
+		got, err := rencode(test.value)
+		if err != nil {
+			t.Fatalf("%v: got error %v", test.value, err)
+		}
+		if !bytes.Equal(got, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.value, test.expected, got)
+		}
+	}
+
+	// integers in decimal and float32 are only ever decoded
+	v, err := rdecode([]byte{rencodeInt, '1', '2', '3', rencodeTerm})
+	if err != nil || v != int64(123) {
+		t.Errorf("Expected 123, got %v %v", v, err)
+	}
+	v, err = rdecode([]byte{rencodeFloat32, 0x3f, 0xc0, 0x00, 0x00})
+	if err != nil || v != 1.5 {
+		t.Errorf("Expected 1.5, got %v %v", v, err)
+	}
+	if _, err := rdecode([]byte{rencodeList, 1, 2}); err == nil {
+		t.Errorf("Expected error for an unterminated list")
+	}
+}
@@ -10,11 +10,18 @@ import (
 	"github.com/nanreh/portpusher/internal/logging"
 )
 
+// How the client reaches Deluge
+const (
+	TransportWeb    = "web"    // deluge-web's /json endpoint, which connects to a daemon for us
+	TransportDaemon = "daemon" // deluged's rencode RPC over TLS, see daemon.go
+)
+
 type Client struct {
 	host          string
 	port          int
 	pass          string
 	user          string
+	transport     string
 	client        *http.Client
 	Log           logging.Logger
 	nextMessageId int
@@ -22,18 +29,32 @@ type Client struct {
 
 // Stringer
 func (c *Client) String() string {
-	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+	return fmt.Sprintf("host=%s port=%d transport=%s", c.host, c.port, c.transport)
 }
 
 func NewClient(host string, port int, user string, pass string, httpClient *http.Client, logger logging.Logger) *Client {
 	logger = &logging.PrefixLogger{Log: logger, Prefix: "deluge: "}
 	return &Client{
-		host:   host,
-		port:   port,
-		user:   user,
-		pass:   pass,
-		client: httpClient,
-		Log:    logger,
+		host:      host,
+		port:      port,
+		user:      user,
+		pass:      pass,
+		transport: TransportWeb,
+		client:    httpClient,
+		Log:       logger,
+	}
+}
+
+// Talks to deluged directly, so deluge-web isn't needed. user and pass are an account from deluged's auth file.
+func NewDaemonClient(host string, port int, user string, pass string, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "deluge: "}
+	return &Client{
+		host:      host,
+		port:      port,
+		user:      user,
+		pass:      pass,
+		transport: TransportDaemon,
+		Log:       logger,
 	}
 }
 
@@ -52,7 +73,11 @@ func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request,
 
 // PortPusher
 func (c *Client) Push(port int) error {
-	if err := c.doPush(port); err != nil {
+	push := c.doPush
+	if c.transport == TransportDaemon {
+		push = c.doPushDaemon
+	}
+	if err := push(port); err != nil {
 		c.Log.Error("push error: %v", err)
 		return err
 	}
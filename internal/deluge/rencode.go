@@ -0,0 +1,316 @@
+package deluge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// rencode type codes, see https://github.com/aresch/rencode
+const (
+	rencodeFloat64 = 44
+	rencodeList    = 59
+	rencodeDict    = 60
+	rencodeInt     = 61
+	rencodeInt1    = 62
+	rencodeInt2    = 63
+	rencodeInt4    = 64
+	rencodeInt8    = 65
+	rencodeFloat32 = 66
+	rencodeTrue    = 67
+	rencodeFalse   = 68
+	rencodeNone    = 69
+	rencodeTerm    = 127
+
+	// small values are packed into the type code
+	rencodeIntPosFixedStart = 0
+	rencodeIntPosFixedCount = 44
+	rencodeIntNegFixedStart = 70
+	rencodeIntNegFixedCount = 32
+	rencodeDictFixedStart   = 102
+	rencodeDictFixedCount   = 25
+	rencodeStrFixedStart    = 128
+	rencodeStrFixedCount    = 64
+	rencodeListFixedStart   = rencodeStrFixedStart + rencodeStrFixedCount
+	rencodeListFixedCount   = 64
+)
+
+// Encodes nil, bool, int, int64, float64, string, []byte, []interface{}, []int and map[string]interface{}
+func rencode(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := rencodeTo(&b, v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func rencodeTo(b *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		b.WriteByte(rencodeNone)
+	case bool:
+		if t {
+			b.WriteByte(rencodeTrue)
+		} else {
+			b.WriteByte(rencodeFalse)
+		}
+	case int:
+		rencodeInteger(b, int64(t))
+	case int64:
+		rencodeInteger(b, t)
+	case float64:
+		b.WriteByte(rencodeFloat64)
+		b.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(t)))
+	case string:
+		rencodeString(b, []byte(t))
+	case []byte:
+		rencodeString(b, t)
+	case []int:
+		list := make([]interface{}, len(t))
+		for i, n := range t {
+			list[i] = n
+		}
+		return rencodeTo(b, list)
+	case []interface{}:
+		if len(t) < rencodeListFixedCount {
+			b.WriteByte(byte(rencodeListFixedStart + len(t)))
+		} else {
+			b.WriteByte(rencodeList)
+		}
+		for _, item := range t {
+			if err := rencodeTo(b, item); err != nil {
+				return err
+			}
+		}
+		if len(t) >= rencodeListFixedCount {
+			b.WriteByte(rencodeTerm)
+		}
+	case map[string]interface{}:
+		if len(t) < rencodeDictFixedCount {
+			b.WriteByte(byte(rencodeDictFixedStart + len(t)))
+		} else {
+			b.WriteByte(rencodeDict)
+		}
+		// sorted so the same value always encodes the same way
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			rencodeString(b, []byte(k))
+			if err := rencodeTo(b, t[k]); err != nil {
+				return err
+			}
+		}
+		if len(t) >= rencodeDictFixedCount {
+			b.WriteByte(rencodeTerm)
+		}
+	default:
+		return fmt.Errorf("can't rencode %T", v)
+	}
+	return nil
+}
+
+func rencodeInteger(b *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n < rencodeIntPosFixedCount:
+		b.WriteByte(byte(rencodeIntPosFixedStart + n))
+	case n < 0 && n >= -rencodeIntNegFixedCount:
+		b.WriteByte(byte(rencodeIntNegFixedStart - 1 - n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		b.WriteByte(rencodeInt1)
+		b.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		b.WriteByte(rencodeInt2)
+		b.Write(binary.BigEndian.AppendUint16(nil, uint16(int16(n))))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		b.WriteByte(rencodeInt4)
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(int32(n))))
+	default:
+		b.WriteByte(rencodeInt8)
+		b.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+	}
+}
+
+func rencodeString(b *bytes.Buffer, s []byte) {
+	if len(s) < rencodeStrFixedCount {
+		b.WriteByte(byte(rencodeStrFixedStart + len(s)))
+	} else {
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+	}
+	b.Write(s)
+}
+
+// Decodes to nil, bool, int64, float64, string, []interface{} and map[string]interface{}.
+// Dict keys that aren't strings are formatted with fmt.
+func rdecode(data []byte) (interface{}, error) {
+	d := &rdecoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("rencode: %d bytes left after the value", len(data)-d.pos)
+	}
+	return v, nil
+}
+
+type rdecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *rdecoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("rencode: truncated data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *rdecoder) value() (interface{}, error) {
+	code, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	c := int(code[0])
+	switch {
+	case c < rencodeIntPosFixedStart+rencodeIntPosFixedCount:
+		return int64(c - rencodeIntPosFixedStart), nil
+	case c >= rencodeIntNegFixedStart && c < rencodeIntNegFixedStart+rencodeIntNegFixedCount:
+		return int64(rencodeIntNegFixedStart - 1 - c), nil
+	case c >= rencodeDictFixedStart && c < rencodeDictFixedStart+rencodeDictFixedCount:
+		return d.dict(c-rencodeDictFixedStart, false)
+	case c >= rencodeStrFixedStart && c < rencodeStrFixedStart+rencodeStrFixedCount:
+		s, err := d.take(c - rencodeStrFixedStart)
+		return string(s), err
+	case c >= rencodeListFixedStart && c < rencodeListFixedStart+rencodeListFixedCount:
+		return d.list(c-rencodeListFixedStart, false)
+	case c >= '0' && c <= '9':
+		return d.longString()
+	}
+	switch c {
+	case rencodeNone:
+		return nil, nil
+	case rencodeTrue:
+		return true, nil
+	case rencodeFalse:
+		return false, nil
+	case rencodeInt1:
+		b, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int8(b[0])), nil
+	case rencodeInt2:
+		b, err := d.take(2)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int16(binary.BigEndian.Uint16(b))), nil
+	case rencodeInt4:
+		b, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int32(binary.BigEndian.Uint32(b))), nil
+	case rencodeInt8:
+		b, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case rencodeInt:
+		end := bytes.IndexByte(d.data[d.pos:], rencodeTerm)
+		if end < 0 {
+			return nil, fmt.Errorf("rencode: unterminated integer")
+		}
+		s, _ := d.take(end)
+		d.pos++ // terminator
+		n, err := strconv.ParseInt(string(s), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("rencode: integer %s out of range", s)
+		}
+		return n, nil
+	case rencodeFloat32:
+		b, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case rencodeFloat64:
+		b, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case rencodeList:
+		return d.list(0, true)
+	case rencodeDict:
+		return d.dict(0, true)
+	}
+	return nil, fmt.Errorf("rencode: unknown type code %d", c)
+}
+
+// A string longer than the fixed ones, its length in decimal followed by a colon
+func (d *rdecoder) longString() (string, error) {
+	d.pos-- // the type code is the first digit
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return "", fmt.Errorf("rencode: invalid string length")
+	}
+	n, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+	if err != nil {
+		return "", fmt.Errorf("rencode: invalid string length")
+	}
+	d.pos += colon + 1
+	s, err := d.take(n)
+	return string(s), err
+}
+
+// Reads n items, or items up to the terminator
+func (d *rdecoder) list(n int, terminated bool) ([]interface{}, error) {
+	list := make([]interface{}, 0, n)
+	for i := 0; terminated || i < n; i++ {
+		if terminated && d.pos < len(d.data) && d.data[d.pos] == rencodeTerm {
+			d.pos++
+			break
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (d *rdecoder) dict(n int, terminated bool) (map[string]interface{}, error) {
+	dict := make(map[string]interface{}, n)
+	for i := 0; terminated || i < n; i++ {
+		if terminated && d.pos < len(d.data) && d.data[d.pos] == rencodeTerm {
+			d.pos++
+			break
+		}
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprint(k)
+		}
+		dict[key] = v
+	}
+	return dict, nil
+}
@@ -2,40 +2,146 @@ package env
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/nanreh/portpusher/internal/amule"
+	"github.com/nanreh/portpusher/internal/aria2"
+	"github.com/nanreh/portpusher/internal/command"
 	"github.com/nanreh/portpusher/internal/deluge"
+	"github.com/nanreh/portpusher/internal/flood"
 	"github.com/nanreh/portpusher/internal/gluetun"
+	"github.com/nanreh/portpusher/internal/httpjson"
+	"github.com/nanreh/portpusher/internal/jsonpath"
+	"github.com/nanreh/portpusher/internal/kubo"
 	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/natpmp"
+	"github.com/nanreh/portpusher/internal/pcp"
+	"github.com/nanreh/portpusher/internal/pia"
+	"github.com/nanreh/portpusher/internal/plex"
+	"github.com/nanreh/portpusher/internal/portfile"
+	"github.com/nanreh/portpusher/internal/ports"
 	"github.com/nanreh/portpusher/internal/qbittorrent"
+	"github.com/nanreh/portpusher/internal/rtorrent"
+	"github.com/nanreh/portpusher/internal/slskd"
+	"github.com/nanreh/portpusher/internal/syncthing"
+	"github.com/nanreh/portpusher/internal/synology"
 	"github.com/nanreh/portpusher/internal/transmission"
+	"github.com/nanreh/portpusher/internal/tribler"
+	"github.com/nanreh/portpusher/internal/upnp"
 )
 
 const (
-	envLogLevel            = "PUSHER_LOG_LEVEL"
-	envDelayError          = "PUSHER_DELAY_ERROR"
-	envDelaySuccess        = "PUSHER_DELAY_SUCCESS"
-	envGluetunHost         = "GLUETUN_HOST"
-	envGluetunPort         = "GLUETUN_PORT"
-	envTransmissionEnabled = "TRANSMISSION_ENABLED"
-	envTransmissionHost    = "TRANSMISSION_HOST"
-	envTransmissionPort    = "TRANSMISSION_PORT"
-	envTransmissionUser    = "TRANSMISSION_USER"
-	envTransmissionPass    = "TRANSMISSION_PASS"
-	envQbittorrentEnabled  = "QBITTORRENT_ENABLED"
-	envQbittorrentHost     = "QBITTORRENT_HOST"
-	envQbittorrentPort     = "QBITTORRENT_PORT"
-	envQbittorrentUser     = "QBITTORRENT_USER"
-	envQbittorrentPass     = "QBITTORRENT_PASS"
-	envDelugeEnabled       = "DELUGE_ENABLED"
-	envDelugeHost          = "DELUGE_HOST"
-	envDelugePort          = "DELUGE_PORT"
-	envDelugeUser          = "DELUGE_USER"
-	envDelugePass          = "DELUGE_PASS"
+	envLogLevel         = "PUSHER_LOG_LEVEL"
+	envDelayError       = "PUSHER_DELAY_ERROR"
+	envDelaySuccess     = "PUSHER_DELAY_SUCCESS"
+	envGluetunHost      = "GLUETUN_HOST"
+	envGluetunPort      = "GLUETUN_PORT"
+	envGluetunApiKey    = "GLUETUN_API_KEY"
+	envGluetunUser      = "GLUETUN_USER"
+	envGluetunPass      = "GLUETUN_PASS"
+	envSource           = "PUSHER_SOURCE"
+	envSourceBackoff    = "PUSHER_SOURCE_BACKOFF"
+	envTunnels          = "PUSHER_TUNNELS"
+	envNatpmpGateway    = "NATPMP_GATEWAY"
+	envNatpmpPort       = "NATPMP_PORT"
+	envNatpmpInternal   = "NATPMP_INTERNAL_PORT"
+	envNatpmpLifetime   = "NATPMP_LIFETIME"
+	envPcpServer        = "PCP_SERVER"
+	envPcpPort          = "PCP_PORT"
+	envPcpInternal      = "PCP_INTERNAL_PORT"
+	envPcpExternal      = "PCP_EXTERNAL_PORT"
+	envPcpLifetime      = "PCP_LIFETIME"
+	envPiaGateway       = "PIA_GATEWAY"
+	envPiaHostname      = "PIA_HOSTNAME"
+	envPiaCaCert        = "PIA_CA_CERT"
+	envPiaToken         = "PIA_TOKEN"
+	envPiaUser          = "PIA_USER"
+	envPiaPass          = "PIA_PASS"
+	envFilePath         = "FILE_PATH"
+	envFileFormat       = "FILE_FORMAT"
+	envFileJSONKey      = "FILE_JSON_KEY"
+	envFileRegex        = "FILE_REGEX"
+	envFilePoll         = "FILE_POLL_INTERVAL"
+	envHTTPURL          = "HTTP_URL"
+	envHTTPMethod       = "HTTP_METHOD"
+	envHTTPBody         = "HTTP_BODY"
+	envHTTPHeaders      = "HTTP_HEADERS"
+	envHTTPUser         = "HTTP_USER"
+	envHTTPPass         = "HTTP_PASS"
+	envHTTPToken        = "HTTP_TOKEN"
+	envHTTPPortPath     = "HTTP_PORT_PATH"
+	envHTTPReadyPath    = "HTTP_READY_PATH"
+	envHTTPReadyValue   = "HTTP_READY_VALUE"
+	envExecCommand      = "EXEC_COMMAND"
+	envExecTimeout      = "EXEC_TIMEOUT"
+	envExecFormat       = "EXEC_FORMAT"
+	envExecJSONKey      = "EXEC_JSON_KEY"
+	envExecRegex        = "EXEC_REGEX"
+	envRestartEnabled   = "GLUETUN_RESTART_ENABLED"
+	envRestartThreshold = "GLUETUN_RESTART_THRESHOLD"
+	envRestartWindow    = "GLUETUN_RESTART_WINDOW"
+	envRestartCooldown  = "GLUETUN_RESTART_COOLDOWN"
+	envRestartMaxPerDay = "GLUETUN_RESTART_MAX_PER_DAY"
+)
+
+// Port sources
+const (
+	SourceGluetun = "gluetun"
+	SourceNatpmp  = "natpmp"
+	SourcePia     = "pia"
+	SourceFile    = "file"
+	SourceHTTP    = "http"
+	SourceExec    = "exec"
+	SourceUpnp    = "upnp"
+	SourcePcp     = "pcp"
+)
+
+// Client instance names. Additional instances of a client are numbered from 2, e.g. QBITTORRENT2.
+const (
+	Transmission = "TRANSMISSION"
+	Qbittorrent  = "QBITTORRENT"
+	Deluge       = "DELUGE"
+	Rtorrent     = "RTORRENT"
+	Aria2        = "ARIA2"
+	Flood        = "FLOOD"
+	Slskd        = "SLSKD"
+	Syncthing    = "SYNCTHING"
+	Plex         = "PLEX"
+	Tribler      = "TRIBLER"
+	Synology     = "SYNOLOGY"
+	Kubo         = "KUBO"
+	Amule        = "AMULE"
+	Upnp         = "UPNP" // a router to open the port on, also the variable prefix of the upnp source
+)
+
+// Client instance variables, appended to the instance name, e.g. QBITTORRENT_HOST or QBITTORRENT2_HOST
+const (
+	envEnabled       = "_ENABLED"
+	envHost          = "_HOST"
+	envPort          = "_PORT"
+	envUser          = "_USER"
+	envPass          = "_PASS"
+	envForwardIndex  = "_FORWARD_INDEX"
+	envForwardOffset = "_FORWARD_OFFSET"
+	envAnnounceIP    = "_ANNOUNCE_IP"
+	envTunnel        = "_TUNNEL"
+	envURL           = "_URL"
+	envInternal      = "_INTERNAL_CLIENT"
+	envExternalPort  = "_EXTERNAL_PORT"
+	envLease         = "_LEASE"
+	envSecret        = "_SECRET"
+	envAPIKey        = "_API_KEY"
+	envToken         = "_TOKEN"
+	envRestartCmd    = "_RESTART_COMMAND"
+	envRestartTime   = "_RESTART_TIMEOUT"
+	envTransport     = "_TRANSPORT"
 )
 
 func GetLogLevel() (int, error) {
@@ -58,12 +164,26 @@ func GetLogLevel() (int, error) {
 	return logLevel, nil
 }
 
-func GetDelaySuccess() (time.Duration, error) {
-	return getDuration(envDelaySuccess, 10*time.Minute)
+// Minutes between pushes after a successful push, PUSHER_DELAY_SUCCESS, a tunnel can override it with
+// e.g. EU_PUSHER_DELAY_SUCCESS
+func GetDelaySuccess(tunnel string) (time.Duration, error) {
+	return getTunnelDuration(tunnel, envDelaySuccess, 10*time.Minute)
 }
 
-func GetDelayError() (time.Duration, error) {
-	return getDuration(envDelaySuccess, 5*time.Minute)
+// Minutes before the next attempt after a failed push, PUSHER_DELAY_ERROR, a tunnel can override it with
+// e.g. EU_PUSHER_DELAY_ERROR
+func GetDelayError(tunnel string) (time.Duration, error) {
+	return getTunnelDuration(tunnel, envDelayError, 5*time.Minute)
+}
+
+// Reads the tunnel's own variable when it is set, the shared one otherwise
+func getTunnelDuration(tunnel string, envVar string, def time.Duration) (time.Duration, error) {
+	if p := tunnelPrefix(tunnel); p != "" {
+		if _, present := os.LookupEnv(p + envVar); present {
+			return getDuration(p+envVar, def)
+		}
+	}
+	return getDuration(envVar, def)
 }
 
 func getDuration(envVar string, def time.Duration) (time.Duration, error) {
@@ -78,6 +198,92 @@ func getDuration(envVar string, def time.Duration) (time.Duration, error) {
 	return def, nil
 }
 
+// Reads which port sources a tunnel uses and in what order, PUSHER_SOURCE, e.g. "gluetun,file,natpmp"
+func GetSources(tunnel string) ([]string, error) {
+	p := tunnelPrefix(tunnel)
+	str, present := os.LookupEnv(p + envSource)
+	if !present {
+		return []string{SourceGluetun}, nil
+	}
+	sources := make([]string, 0, 1)
+	for _, source := range strings.Split(str, ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		switch source {
+		case SourceGluetun, SourceNatpmp, SourcePcp, SourcePia, SourceFile, SourceHTTP, SourceExec, SourceUpnp:
+		default:
+			return nil, fmt.Errorf("env.%s has invalid value %s. Valid values are a comma separated list of %s, %s, %s, %s, %s, %s, %s, %s", p+envSource, source, SourceGluetun, SourceNatpmp, SourcePcp, SourcePia, SourceFile, SourceHTTP, SourceExec, SourceUpnp)
+		}
+		if slices.Contains(sources, source) {
+			return nil, fmt.Errorf("env.%s lists %s more than once", p+envSource, source)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// How long a source that just failed is skipped before it's tried again, PUSHER_SOURCE_BACKOFF
+func GetSourceBackoff(tunnel string) (time.Duration, error) {
+	return getDuration(tunnelPrefix(tunnel)+envSourceBackoff, 10*time.Minute)
+}
+
+// Reads the named tunnels, PUSHER_TUNNELS, e.g. "eu,us". Each tunnel has its own sources, configured with
+// the usual variables prefixed by the tunnel name (EU_PUSHER_SOURCE, EU_GLUETUN_HOST, ...).
+// Without PUSHER_TUNNELS there is a single unnamed tunnel configured by the plain variables.
+func GetTunnels() ([]string, error) {
+	str, present := os.LookupEnv(envTunnels)
+	if !present {
+		return []string{""}, nil
+	}
+	tunnels := make([]string, 0, 2)
+	for _, tunnel := range strings.Split(str, ",") {
+		tunnel = strings.ToLower(strings.TrimSpace(tunnel))
+		if !validTunnel(tunnel) {
+			return nil, fmt.Errorf("env.%s has invalid tunnel name %q. Names are letters and digits, starting with a letter", envTunnels, tunnel)
+		}
+		if slices.Contains(tunnels, tunnel) {
+			return nil, fmt.Errorf("env.%s lists %s more than once", envTunnels, tunnel)
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels, nil
+}
+
+func validTunnel(tunnel string) bool {
+	if tunnel == "" || tunnel[0] < 'a' || tunnel[0] > 'z' {
+		return false
+	}
+	for _, r := range tunnel {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads which tunnel an instance gets its port from, <instance>_TUNNEL. Defaults to the first tunnel.
+func GetTunnel(instance string, tunnels []string) (string, error) {
+	tunnel, present := os.LookupEnv(instance + envTunnel)
+	if !present {
+		return tunnels[0], nil
+	}
+	tunnel = strings.ToLower(strings.TrimSpace(tunnel))
+	if !slices.Contains(tunnels, tunnel) {
+		if _, present := os.LookupEnv(envTunnels); !present {
+			return "", fmt.Errorf("env.%s is set but env.%s is missing", instance+envTunnel, envTunnels)
+		}
+		return "", fmt.Errorf("env.%s has invalid value %s. Valid values are %s", instance+envTunnel, tunnel, strings.Join(tunnels, ", "))
+	}
+	return tunnel, nil
+}
+
+// Variable prefix of a named tunnel, "EU_" for eu
+func tunnelPrefix(tunnel string) string {
+	if tunnel == "" {
+		return ""
+	}
+	return strings.ToUpper(tunnel) + "_"
+}
+
 func getPort(envVar string, def int) (int, error) {
 	portStr, present := os.LookupEnv(envVar)
 	port := def
@@ -91,6 +297,18 @@ func getPort(envVar string, def int) (int, error) {
 	return port, nil
 }
 
+func getInt(envVar string, def int) (int, error) {
+	str, present := os.LookupEnv(envVar)
+	if present {
+		i, err := strconv.Atoi(str)
+		if err != nil {
+			return def, fmt.Errorf("env.%s has invalid value: %s. Valid values are whole numbers", envVar, str)
+		}
+		return i, nil
+	}
+	return def, nil
+}
+
 func getBool(envVar string, def bool) bool {
 	str, present := os.LookupEnv(envVar)
 	if present {
@@ -99,114 +317,855 @@ func getBool(envVar string, def bool) bool {
 	return def
 }
 
-func GetGluetunClient(httpClient *http.Client, logger logging.Logger) (*gluetun.Client, error) {
-	host, present := os.LookupEnv(envGluetunHost)
+// Lists the configured instances of a client: the name itself followed by name2, name3, ...
+// for as long as a <name><n>_ENABLED variable is present.
+func Instances(name string) []string {
+	instances := []string{name}
+	for n := 2; ; n++ {
+		instance := fmt.Sprintf("%s%d", name, n)
+		if _, present := os.LookupEnv(instance + envEnabled); !present {
+			return instances
+		}
+		instances = append(instances, instance)
+	}
+}
+
+// Reads which forwarded port an instance uses, <instance>_FORWARD_INDEX and <instance>_FORWARD_OFFSET
+func GetPortMapping(instance string) (ports.Mapping, error) {
+	index, err := getInt(instance+envForwardIndex, 0)
+	if err != nil {
+		return ports.Mapping{}, err
+	}
+	if index < 0 {
+		return ports.Mapping{}, fmt.Errorf("env.%s has invalid value: %d. Valid values are 0 or greater", instance+envForwardIndex, index)
+	}
+
+	offset, err := getInt(instance+envForwardOffset, 0)
+	if err != nil {
+		return ports.Mapping{}, err
+	}
+	return ports.Mapping{Index: index, Offset: offset}, nil
+}
+
+// Reads whether an instance wants the VPN public IP pushed as its announce IP, <instance>_ANNOUNCE_IP
+func GetAnnounceIP(instance string) bool {
+	return getBool(instance+envAnnounceIP, false)
+}
+
+// Additional instances log with their instance name so they can be told apart
+func instanceLogger(name string, instance string, logger logging.Logger) logging.Logger {
+	if instance == name {
+		return logger
+	}
+	return &logging.PrefixLogger{Log: logger, Prefix: "[" + strings.ToLower(instance) + "] "}
+}
+
+func GetGluetunClient(tunnel string, httpClient *http.Client, logger logging.Logger) (*gluetun.Client, error) {
+	p := tunnelPrefix(tunnel)
+	host, present := os.LookupEnv(p + envGluetunHost)
 	if !present {
 		host = "localhost"
 	}
 
-	port, err := getPort(envGluetunPort, 8000)
+	port, err := getPort(p+envGluetunPort, 8000)
 	if err != nil {
 		return nil, err
 	}
 
 	c := gluetun.NewClient(host, port, httpClient, logger)
+
+	if apiKey, present := os.LookupEnv(p + envGluetunApiKey); present {
+		c.SetAPIKey(apiKey)
+	}
+
+	if user, present := os.LookupEnv(p + envGluetunUser); present {
+		pass, present := os.LookupEnv(p + envGluetunPass)
+		if !present {
+			return nil, fmt.Errorf("env.%s is set but env.%s is missing", p+envGluetunUser, p+envGluetunPass)
+		}
+		c.SetBasicAuth(user, pass)
+	}
+
 	c.Log.Info("Client ready %s", c)
 	return c, nil
 }
 
-func GetTransmissionClient(httpClient *http.Client, logger logging.Logger) (*transmission.Client, error) {
-	enabled := getBool(envTransmissionEnabled, false)
+func GetNatpmpClient(tunnel string, logger logging.Logger) (*natpmp.Client, error) {
+	p := tunnelPrefix(tunnel)
+	gateway, present := os.LookupEnv(p + envNatpmpGateway)
+	if !present {
+		return nil, fmt.Errorf("env.%s is required for the %s source", p+envNatpmpGateway, SourceNatpmp)
+	}
+
+	port, err := getPort(p+envNatpmpPort, 5351)
+	if err != nil {
+		return nil, err
+	}
+
+	internalPort, err := getPort(p+envNatpmpInternal, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime, err := getInt(p+envNatpmpLifetime, 60)
+	if err != nil {
+		return nil, err
+	}
+	if lifetime <= 0 {
+		return nil, fmt.Errorf("env.%s has invalid value: %d. Valid values are any number of seconds > 0", p+envNatpmpLifetime, lifetime)
+	}
+
+	c := natpmp.NewClient(gateway, port, internalPort, time.Duration(lifetime)*time.Second, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetPcpClient(tunnel string, logger logging.Logger) (*pcp.Client, error) {
+	p := tunnelPrefix(tunnel)
+	server, present := os.LookupEnv(p + envPcpServer)
+	if !present {
+		return nil, fmt.Errorf("env.%s is required for the %s source", p+envPcpServer, SourcePcp)
+	}
+
+	port, err := getPort(p+envPcpPort, 5351)
+	if err != nil {
+		return nil, err
+	}
+
+	internalPort, err := getPort(p+envPcpInternal, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	externalPort, err := getPort(p+envPcpExternal, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime, err := getInt(p+envPcpLifetime, 120)
+	if err != nil {
+		return nil, err
+	}
+	if lifetime <= 0 {
+		return nil, fmt.Errorf("env.%s has invalid value: %d. Valid values are any number of seconds > 0", p+envPcpLifetime, lifetime)
+	}
+
+	c := pcp.NewClient(server, port, internalPort, time.Duration(lifetime)*time.Second, logger)
+	c.SetExternalPort(externalPort)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetPiaClient(tunnel string, logger logging.Logger) (*pia.Client, error) {
+	p := tunnelPrefix(tunnel)
+	gateway, present := os.LookupEnv(p + envPiaGateway)
+	if !present {
+		return nil, fmt.Errorf("env.%s is required for the %s source", p+envPiaGateway, SourcePia)
+	}
+
+	hostname, present := os.LookupEnv(p + envPiaHostname)
+	if !present {
+		return nil, fmt.Errorf("env.%s is required for the %s source", p+envPiaHostname, SourcePia)
+	}
+
+	caPath, present := os.LookupEnv(p + envPiaCaCert)
+	if !present {
+		return nil, fmt.Errorf("env.%s is required for the %s source", p+envPiaCaCert, SourcePia)
+	}
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read env.%s: %s", p+envPiaCaCert, err)
+	}
+
+	httpClient, err := pia.NewHTTPClient(gateway, hostname, caPEM)
+	if err != nil {
+		return nil, fmt.Errorf("env.%s: %s", p+envPiaCaCert, err)
+	}
+	c := pia.NewClient(hostname, httpClient, logger)
+
+	token, hasToken := os.LookupEnv(p + envPiaToken)
+	user, hasUser := os.LookupEnv(p + envPiaUser)
+	switch {
+	case hasUser:
+		pass, present := os.LookupEnv(p + envPiaPass)
+		if !present {
+			return nil, fmt.Errorf("env.%s is set but env.%s is missing", p+envPiaUser, p+envPiaPass)
+		}
+		c.SetLogin(user, pass)
+	case hasToken:
+		c.SetToken(token)
+	default:
+		return nil, fmt.Errorf("env.%s or env.%s/env.%s is required for the %s source", p+envPiaToken, p+envPiaUser, p+envPiaPass, SourcePia)
+	}
+
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetFileClient(tunnel string, logger logging.Logger) (*portfile.Client, error) {
+	p := tunnelPrefix(tunnel)
+	path, present := os.LookupEnv(p + envFilePath)
+	if !present {
+		path = "/tmp/gluetun/forwarded_port"
+	}
+
+	format, parse, err := getParser(p+envFileFormat, p+envFileJSONKey, p+envFileRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := getInt(p+envFilePoll, 15)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("env.%s has invalid value: %d. Valid values are any number of seconds > 0", p+envFilePoll, interval)
+	}
+
+	c := portfile.NewClient(path, format, parse, time.Duration(interval)*time.Second, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetHTTPClient(tunnel string, httpClient *http.Client, logger logging.Logger) (*httpjson.Client, error) {
+	p := tunnelPrefix(tunnel)
+	url, present := os.LookupEnv(p + envHTTPURL)
+	if !present {
+		return nil, fmt.Errorf("env.%s is required for the %s source", p+envHTTPURL, SourceHTTP)
+	}
+
+	method, present := os.LookupEnv(p + envHTTPMethod)
+	if !present {
+		method = http.MethodGet
+	}
+	method = strings.ToUpper(method)
+	if method != http.MethodGet && method != http.MethodPost {
+		return nil, fmt.Errorf("env.%s has invalid value %s. Valid values are GET, POST", p+envHTTPMethod, method)
+	}
+
+	expr, present := os.LookupEnv(p + envHTTPPortPath)
+	if !present {
+		expr = "$.port"
+	}
+	portPath, err := jsonpath.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("env.%s has invalid value: %s", p+envHTTPPortPath, err)
+	}
+
+	c := httpjson.NewClient(url, method, portPath, httpClient, logger)
+
+	if body, present := os.LookupEnv(p + envHTTPBody); present {
+		c.SetBody(body)
+	}
+
+	// "Name: value" pairs separated by ; or newlines
+	if headers, present := os.LookupEnv(p + envHTTPHeaders); present {
+		for _, h := range strings.FieldsFunc(headers, func(r rune) bool { return r == ';' || r == '\n' }) {
+			name, value, found := strings.Cut(h, ":")
+			if !found || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("env.%s has invalid header %q. Headers look like Name: value", p+envHTTPHeaders, h)
+			}
+			c.AddHeader(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
+	if token, present := os.LookupEnv(p + envHTTPToken); present {
+		c.SetBearerToken(token)
+	}
+	if user, present := os.LookupEnv(p + envHTTPUser); present {
+		pass, present := os.LookupEnv(p + envHTTPPass)
+		if !present {
+			return nil, fmt.Errorf("env.%s is set but env.%s is missing", p+envHTTPUser, p+envHTTPPass)
+		}
+		c.SetBasicAuth(user, pass)
+	}
+
+	if expr, present := os.LookupEnv(p + envHTTPReadyPath); present {
+		readyPath, err := jsonpath.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("env.%s has invalid value: %s", p+envHTTPReadyPath, err)
+		}
+		value, present := os.LookupEnv(p + envHTTPReadyValue)
+		if !present {
+			value = "true"
+		}
+		c.SetReady(readyPath, value)
+	}
+
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetExecClient(tunnel string, logger logging.Logger) (*command.Client, error) {
+	p := tunnelPrefix(tunnel)
+	cmd, present := os.LookupEnv(p + envExecCommand)
+	if !present {
+		return nil, fmt.Errorf("env.%s is required for the %s source", p+envExecCommand, SourceExec)
+	}
+
+	timeout, err := getInt(p+envExecTimeout, 30)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("env.%s has invalid value: %d. Valid values are any number of seconds > 0", p+envExecTimeout, timeout)
+	}
+
+	format, parse, err := getParser(p+envExecFormat, p+envExecJSONKey, p+envExecRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	c := command.NewClient(cmd, time.Duration(timeout)*time.Second, format, parse, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+// Builds the upnp source, configured by UPNP_URL, UPNP_INTERNAL_CLIENT, UPNP_EXTERNAL_PORT and UPNP_LEASE
+func GetUpnpClient(tunnel string, httpClient *http.Client, logger logging.Logger) (*upnp.Client, error) {
+	name := tunnelPrefix(tunnel) + Upnp
+	c, err := getUpnpClient(name, httpClient, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := getPort(name+envExternalPort, 0)
+	if err != nil {
+		return nil, err
+	}
+	c.SetExternalPort(port)
+
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func getUpnpClient(name string, httpClient *http.Client, logger logging.Logger) (*upnp.Client, error) {
+	location, _ := os.LookupEnv(name + envURL)
+	internalClient, _ := os.LookupEnv(name + envInternal)
+	if internalClient != "" && net.ParseIP(internalClient) == nil {
+		return nil, fmt.Errorf("env.%s has invalid value %s. Valid values are IP addresses", name+envInternal, internalClient)
+	}
+
+	lease, err := getInt(name+envLease, 3600)
+	if err != nil {
+		return nil, err
+	}
+	if lease < 0 {
+		return nil, fmt.Errorf("env.%s has invalid value: %d. Valid values are 0 (permanent) or any number of seconds", name+envLease, lease)
+	}
+
+	return upnp.NewClient(location, internalClient, time.Duration(lease)*time.Second, httpClient, logger), nil
+}
+
+// Builds a port parser from a format variable (int, json or regex) and the variables holding its JSON key and regex
+func getParser(envFormat string, envJSONKey string, envRegex string) (string, ports.Parser, error) {
+	format, present := os.LookupEnv(envFormat)
+	if !present {
+		format = "int"
+	}
+	format = strings.ToLower(format)
+	switch format {
+	case "int":
+		return format, ports.IntParser(), nil
+	case "json":
+		key, present := os.LookupEnv(envJSONKey)
+		if !present {
+			key = "$.port"
+		}
+		parse, err := ports.JSONParser(key)
+		if err != nil {
+			return format, nil, fmt.Errorf("env.%s has invalid value: %s", envJSONKey, err)
+		}
+		return format, parse, nil
+	case "regex":
+		expr, present := os.LookupEnv(envRegex)
+		if !present {
+			return format, nil, fmt.Errorf("env.%s is required when env.%s is regex", envRegex, envFormat)
+		}
+		parse, err := ports.RegexParser(expr)
+		if err != nil {
+			return format, nil, fmt.Errorf("env.%s has invalid value: %s", envRegex, err)
+		}
+		return format, parse, nil
+	default:
+		return format, nil, fmt.Errorf("env.%s has invalid value %s. Valid values are int, json, regex", envFormat, format)
+	}
+}
+
+// Builds the opt-in VPN restart policy, nil when it isn't enabled.
+// The remediator still has to be set on the client.
+func GetGluetunRemediator(tunnel string, gtc *gluetun.Client, logger logging.Logger) (*gluetun.Remediator, error) {
+	p := tunnelPrefix(tunnel)
+	enabled := getBool(p+envRestartEnabled, false)
 	if !enabled {
-		logger.Debug("Transmission disabled")
+		logger.Debug("Gluetun restart disabled")
 		return nil, nil
 	}
 
-	host, present := os.LookupEnv(envTransmissionHost)
+	threshold, err := getInt(p+envRestartThreshold, 3)
+	if err != nil {
+		return nil, err
+	}
+	if threshold <= 0 {
+		return nil, fmt.Errorf("env.%s has invalid value: %d. Valid values are 1 or greater", p+envRestartThreshold, threshold)
+	}
+
+	window, err := getDuration(p+envRestartWindow, 30*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	cooldown, err := getDuration(p+envRestartCooldown, 60*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	maxPerDay, err := getInt(p+envRestartMaxPerDay, 3)
+	if err != nil {
+		return nil, err
+	}
+	if maxPerDay <= 0 {
+		return nil, fmt.Errorf("env.%s has invalid value: %d. Valid values are 1 or greater", p+envRestartMaxPerDay, maxPerDay)
+	}
+
+	policy := gluetun.RemediationPolicy{
+		Threshold: threshold,
+		Window:    window,
+		Cooldown:  cooldown,
+		MaxPerDay: maxPerDay,
+	}
+	r := gluetun.NewRemediator(policy, gtc, logger)
+	r.Log.Info("Restart policy ready threshold=%d window=%v cooldown=%v max_per_day=%d", threshold, window, cooldown, maxPerDay)
+	return r, nil
+}
+
+func GetTransmissionClient(instance string, httpClient *http.Client, logger logging.Logger) (*transmission.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
 	if !present {
 		host = "localhost"
 	}
 
-	port, err := getPort(envTransmissionPort, 9091)
+	port, err := getPort(instance+envPort, 9091)
 	if err != nil {
 		return nil, err
 	}
 
-	user, present := os.LookupEnv(envTransmissionUser)
+	user, present := os.LookupEnv(instance + envUser)
 	if !present {
 		user = "admin"
 	}
 
-	pass, present := os.LookupEnv(envTransmissionPass)
+	pass, present := os.LookupEnv(instance + envPass)
 	if !present {
 		pass = "password"
 	}
 
+	logger = instanceLogger(Transmission, instance, logger)
 	c := transmission.NewClient(host, port, user, pass, httpClient, logger)
 	c.Log.Info("Client ready %s", c)
 	return c, nil
 }
 
-func GetQbittorrentClient(httpClient *http.Client, logger logging.Logger) (*qbittorrent.Client, error) {
-	enabled := getBool(envQbittorrentEnabled, false)
+func GetQbittorrentClient(instance string, httpClient *http.Client, logger logging.Logger) (*qbittorrent.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
 	if !enabled {
-		logger.Debug("QBittorrent disabled")
+		logger.Debug("%s disabled", instance)
 		return nil, nil
 	}
 
-	host, present := os.LookupEnv(envQbittorrentHost)
+	host, present := os.LookupEnv(instance + envHost)
 	if !present {
 		host = "localhost"
 	}
 
-	port, err := getPort(envQbittorrentPort, 8080)
+	port, err := getPort(instance+envPort, 8080)
 	if err != nil {
 		return nil, err
 	}
 
-	user, present := os.LookupEnv(envQbittorrentUser)
+	user, present := os.LookupEnv(instance + envUser)
 	if !present {
 		user = "admin"
 	}
 
-	pass, present := os.LookupEnv(envQbittorrentPass)
+	pass, present := os.LookupEnv(instance + envPass)
 	if !present {
 		pass = "adminadmin"
 	}
 
+	logger = instanceLogger(Qbittorrent, instance, logger)
 	c := qbittorrent.NewClient(host, port, user, pass, httpClient, logger)
 	c.Log.Info("Client ready %s", c)
 	return c, nil
 }
 
-func GetDelugeClient(httpClient *http.Client, logger logging.Logger) (*deluge.Client, error) {
-	enabled := getBool(envDelugeEnabled, false)
+func GetDelugeClient(instance string, httpClient *http.Client, logger logging.Logger) (*deluge.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
 	if !enabled {
-		logger.Debug("Delug disabled")
+		logger.Debug("%s disabled", instance)
 		return nil, nil
 	}
 
-	host, present := os.LookupEnv(envDelugeHost)
+	host, present := os.LookupEnv(instance + envHost)
 	if !present {
 		host = "localhost"
 	}
 
-	port, err := getPort(envDelugePort, 8112)
+	transport, present := os.LookupEnv(instance + envTransport)
+	if !present {
+		transport = deluge.TransportWeb
+	}
+	defaultPort := 8112
+	switch transport {
+	case deluge.TransportWeb:
+	case deluge.TransportDaemon:
+		defaultPort = 58846
+	default:
+		return nil, fmt.Errorf("env.%s has invalid value %s. Valid values are %s or %s", instance+envTransport, transport, deluge.TransportWeb, deluge.TransportDaemon)
+	}
+
+	port, err := getPort(instance+envPort, defaultPort)
 	if err != nil {
 		return nil, err
 	}
 
-	user, present := os.LookupEnv(envDelugeUser)
+	user, present := os.LookupEnv(instance + envUser)
 	if !present {
 		user = "admin"
 	}
 
-	pass, present := os.LookupEnv(envDelugePass)
+	pass, present := os.LookupEnv(instance + envPass)
 	if !present {
 		pass = "deluge"
 	}
 
-	c := deluge.NewClient(host, port, user, pass, httpClient, logger)
+	logger = instanceLogger(Deluge, instance, logger)
+	var c *deluge.Client
+	if transport == deluge.TransportDaemon {
+		c = deluge.NewDaemonClient(host, port, user, pass, logger)
+	} else {
+		c = deluge.NewClient(host, port, user, pass, httpClient, logger)
+	}
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetRtorrentClient(instance string, httpClient *http.Client, logger logging.Logger) (*rtorrent.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	rawURL, present := os.LookupEnv(instance + envURL)
+	if !present {
+		rawURL = "scgi://localhost:5000"
+	}
+	rpcURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("env.%s has invalid value: %s", instance+envURL, err)
+	}
+	switch rpcURL.Scheme {
+	case "http", "https", "scgi", "unix":
+	default:
+		return nil, fmt.Errorf("env.%s has invalid value %s. Valid URLs start with http://, https://, scgi:// or unix://", instance+envURL, rawURL)
+	}
+
+	// only used by web servers in front of rTorrent, e.g. ruTorrent
+	user, _ := os.LookupEnv(instance + envUser)
+	pass, _ := os.LookupEnv(instance + envPass)
+
+	logger = instanceLogger(Rtorrent, instance, logger)
+	c := rtorrent.NewClient(rpcURL, user, pass, httpClient, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetAria2Client(instance string, httpClient *http.Client, logger logging.Logger) (*aria2.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	rawURL, present := os.LookupEnv(instance + envURL)
+	if !present {
+		rawURL = "http://localhost:6800/jsonrpc"
+	}
+	rpcURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("env.%s has invalid value: %s", instance+envURL, err)
+	}
+	switch rpcURL.Scheme {
+	case "http", "https", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("env.%s has invalid value %s. Valid URLs start with http://, https://, ws:// or wss://", instance+envURL, rawURL)
+	}
+
+	// aria2's --rpc-secret, empty when it isn't set
+	secret, _ := os.LookupEnv(instance + envSecret)
+
+	logger = instanceLogger(Aria2, instance, logger)
+	c := aria2.NewClient(rpcURL, secret, httpClient, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetFloodClient(instance string, httpClient *http.Client, logger logging.Logger) (*flood.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
+	if !present {
+		host = "localhost"
+	}
+
+	port, err := getPort(instance+envPort, 3000)
+	if err != nil {
+		return nil, err
+	}
+
+	// empty when Flood runs with --auth none
+	user, _ := os.LookupEnv(instance + envUser)
+	pass, _ := os.LookupEnv(instance + envPass)
+
+	logger = instanceLogger(Flood, instance, logger)
+	c := flood.NewClient(host, port, user, pass, httpClient, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetSlskdClient(instance string, httpClient *http.Client, logger logging.Logger) (*slskd.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
+	if !present {
+		host = "localhost"
+	}
+
+	port, err := getPort(instance+envPort, 5030)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, present := os.LookupEnv(instance + envAPIKey)
+	if !present || apiKey == "" {
+		return nil, fmt.Errorf("env.%s is required", instance+envAPIKey)
+	}
+
+	logger = instanceLogger(Slskd, instance, logger)
+	c := slskd.NewClient(host, port, apiKey, httpClient, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetSyncthingClient(instance string, httpClient *http.Client, logger logging.Logger) (*syncthing.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
+	if !present {
+		host = "localhost"
+	}
+
+	port, err := getPort(instance+envPort, 8384)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, present := os.LookupEnv(instance + envAPIKey)
+	if !present || apiKey == "" {
+		return nil, fmt.Errorf("env.%s is required", instance+envAPIKey)
+	}
+
+	logger = instanceLogger(Syncthing, instance, logger)
+	c := syncthing.NewClient(host, port, apiKey, httpClient, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetPlexClient(instance string, httpClient *http.Client, logger logging.Logger) (*plex.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
+	if !present {
+		host = "localhost"
+	}
+
+	port, err := getPort(instance+envPort, 32400)
+	if err != nil {
+		return nil, err
+	}
+
+	token, present := os.LookupEnv(instance + envToken)
+	if !present || token == "" {
+		return nil, fmt.Errorf("env.%s is required", instance+envToken)
+	}
+
+	logger = instanceLogger(Plex, instance, logger)
+	c := plex.NewClient(host, port, token, httpClient, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetTriblerClient(instance string, httpClient *http.Client, logger logging.Logger) (*tribler.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
+	if !present {
+		host = "localhost"
+	}
+
+	port, err := getPort(instance+envPort, 20100)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, present := os.LookupEnv(instance + envAPIKey)
+	if !present || apiKey == "" {
+		return nil, fmt.Errorf("env.%s is required", instance+envAPIKey)
+	}
+
+	logger = instanceLogger(Tribler, instance, logger)
+	c := tribler.NewClient(host, port, apiKey, httpClient, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetSynologyClient(instance string, httpClient *http.Client, logger logging.Logger) (*synology.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
+	if !present {
+		host = "localhost"
+	}
+
+	port, err := getPort(instance+envPort, 5000)
+	if err != nil {
+		return nil, err
+	}
+
+	user, present := os.LookupEnv(instance + envUser)
+	if !present {
+		user = "admin"
+	}
+
+	pass, present := os.LookupEnv(instance + envPass)
+	if !present || pass == "" {
+		return nil, fmt.Errorf("env.%s is required", instance+envPass)
+	}
+
+	logger = instanceLogger(Synology, instance, logger)
+	c := synology.NewClient(host, port, user, pass, httpClient, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetKuboClient(instance string, httpClient *http.Client, logger logging.Logger) (*kubo.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
+	if !present {
+		host = "localhost"
+	}
+
+	port, err := getPort(instance+envPort, 5001)
+	if err != nil {
+		return nil, err
+	}
+
+	logger = instanceLogger(Kubo, instance, logger)
+	c := kubo.NewClient(host, port, httpClient, logger)
+
+	// Kubo only listens on a new swarm port after a restart
+	if cmd, present := os.LookupEnv(instance + envRestartCmd); present && cmd != "" {
+		timeout, err := getInt(instance+envRestartTime, 60)
+		if err != nil {
+			return nil, err
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("env.%s has invalid value: %d. Valid values are any number of seconds > 0", instance+envRestartTime, timeout)
+		}
+		c.SetRestartCommand(cmd, time.Duration(timeout)*time.Second)
+	}
+
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+// aMule speaks EC over its own TCP connection, httpClient is unused
+func GetAmuleClient(instance string, _ *http.Client, logger logging.Logger) (*amule.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	host, present := os.LookupEnv(instance + envHost)
+	if !present {
+		host = "localhost"
+	}
+
+	port, err := getPort(instance+envPort, 4712)
+	if err != nil {
+		return nil, err
+	}
+
+	pass, present := os.LookupEnv(instance + envPass)
+	if !present || pass == "" {
+		return nil, fmt.Errorf("env.%s is required", instance+envPass)
+	}
+
+	logger = instanceLogger(Amule, instance, logger)
+	c := amule.NewClient(host, port, pass, logger)
+	c.Log.Info("Client ready %s", c)
+	return c, nil
+}
+
+func GetUpnpSink(instance string, httpClient *http.Client, logger logging.Logger) (*upnp.Client, error) {
+	enabled := getBool(instance+envEnabled, false)
+	if !enabled {
+		logger.Debug("%s disabled", instance)
+		return nil, nil
+	}
+
+	logger = instanceLogger(Upnp, instance, logger)
+	c, err := getUpnpClient(instance, httpClient, logger)
+	if err != nil {
+		return nil, err
+	}
 	c.Log.Info("Client ready %s", c)
 	return c, nil
 }
@@ -6,7 +6,7 @@ import (
 )
 
 func TestGetDelaySuccess(t *testing.T) {
-	d, err := GetDelaySuccess()
+	d, err := GetDelaySuccess("")
 	if err != nil {
 		t.Errorf("got error %v", err)
 	}
@@ -17,7 +17,7 @@ func TestGetDelaySuccess(t *testing.T) {
 }
 
 func TestGetDelayError(t *testing.T) {
-	d, err := GetDelayError()
+	d, err := GetDelayError("")
 	if err != nil {
 		t.Errorf("got error %v", err)
 	}
@@ -26,3 +26,124 @@ func TestGetDelayError(t *testing.T) {
 		t.Errorf("Expected default of %v, got %v", expected, d)
 	}
 }
+
+func TestTunnelDelays(t *testing.T) {
+	t.Setenv("PUSHER_DELAY_ERROR", "2")
+	t.Setenv("EU_PUSHER_DELAY_ERROR", "1")
+	t.Setenv("EU_PUSHER_DELAY_SUCCESS", "30")
+
+	if d, err := GetDelayError(""); err != nil || d != 2*time.Minute {
+		t.Errorf("Expected 2m, got %v %v", d, err)
+	}
+	if d, err := GetDelayError("eu"); err != nil || d != time.Minute {
+		t.Errorf("Expected the eu override of 1m, got %v %v", d, err)
+	}
+	if d, err := GetDelayError("us"); err != nil || d != 2*time.Minute {
+		t.Errorf("Expected the shared 2m, got %v %v", d, err)
+	}
+	if d, err := GetDelaySuccess("eu"); err != nil || d != 30*time.Minute {
+		t.Errorf("Expected the eu override of 30m, got %v %v", d, err)
+	}
+	if d, err := GetDelaySuccess("us"); err != nil || d != 10*time.Minute {
+		t.Errorf("Expected the default of 10m, got %v %v", d, err)
+	}
+
+	t.Setenv("US_PUSHER_DELAY_SUCCESS", "soon")
+	if _, err := GetDelaySuccess("us"); err == nil {
+		t.Errorf("Expected an error for an invalid override")
+	}
+}
+
+func TestInstances(t *testing.T) {
+	t.Setenv("QBITTORRENT2_ENABLED", "true")
+	t.Setenv("QBITTORRENT3_ENABLED", "false")
+	t.Setenv("QBITTORRENT5_ENABLED", "true")
+	instances := Instances(Qbittorrent)
+	expected := []string{"QBITTORRENT", "QBITTORRENT2", "QBITTORRENT3"}
+	if len(instances) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, instances)
+	}
+	for i := range expected {
+		if instances[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, instances)
+		}
+	}
+}
+
+func TestGetPortMapping(t *testing.T) {
+	t.Setenv("QBITTORRENT2_FORWARD_INDEX", "1")
+	t.Setenv("QBITTORRENT2_FORWARD_OFFSET", "-2")
+	m, err := GetPortMapping("QBITTORRENT2")
+	if err != nil {
+		t.Errorf("got error %v", err)
+	}
+	if m.Index != 1 || m.Offset != -2 {
+		t.Errorf("Expected index=1 offset=-2, got %v", m)
+	}
+
+	t.Setenv("QBITTORRENT2_FORWARD_INDEX", "-1")
+	if _, err := GetPortMapping("QBITTORRENT2"); err == nil {
+		t.Errorf("Expected error for negative index")
+	}
+}
+
+func TestGetTunnels(t *testing.T) {
+	tunnels, err := GetTunnels()
+	if err != nil || len(tunnels) != 1 || tunnels[0] != "" {
+		t.Errorf("Expected a single unnamed tunnel, got %q %v", tunnels, err)
+	}
+
+	t.Setenv("PUSHER_TUNNELS", "EU, us2")
+	tunnels, err = GetTunnels()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(tunnels) != 2 || tunnels[0] != "eu" || tunnels[1] != "us2" {
+		t.Errorf("Expected [eu us2], got %v", tunnels)
+	}
+
+	for _, invalid := range []string{"eu,eu", "eu,", "2eu", "e-u"} {
+		t.Setenv("PUSHER_TUNNELS", invalid)
+		if _, err := GetTunnels(); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestGetTunnel(t *testing.T) {
+	t.Setenv("PUSHER_TUNNELS", "eu,us")
+	t.Setenv("QBITTORRENT2_TUNNEL", "US")
+	tunnels := []string{"eu", "us"}
+
+	tunnel, err := GetTunnel("QBITTORRENT", tunnels)
+	if err != nil || tunnel != "eu" {
+		t.Errorf("Expected the first tunnel by default, got %s %v", tunnel, err)
+	}
+	tunnel, err = GetTunnel("QBITTORRENT2", tunnels)
+	if err != nil || tunnel != "us" {
+		t.Errorf("Expected us, got %s %v", tunnel, err)
+	}
+
+	t.Setenv("DELUGE_TUNNEL", "asia")
+	if _, err := GetTunnel("DELUGE", tunnels); err == nil {
+		t.Errorf("Expected an error for an unknown tunnel")
+	}
+}
+
+func TestTunnelVariables(t *testing.T) {
+	t.Setenv("PUSHER_SOURCE", "natpmp")
+	t.Setenv("EU_PUSHER_SOURCE", "file,gluetun")
+
+	sources, err := GetSources("")
+	if err != nil || len(sources) != 1 || sources[0] != SourceNatpmp {
+		t.Errorf("Expected [natpmp], got %v %v", sources, err)
+	}
+	sources, err = GetSources("eu")
+	if err != nil || len(sources) != 2 || sources[0] != SourceFile || sources[1] != SourceGluetun {
+		t.Errorf("Expected [file gluetun], got %v %v", sources, err)
+	}
+	sources, err = GetSources("us")
+	if err != nil || len(sources) != 1 || sources[0] != SourceGluetun {
+		t.Errorf("Expected the default [gluetun], got %v %v", sources, err)
+	}
+}
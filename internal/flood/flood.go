@@ -0,0 +1,173 @@
+package flood
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Pushes the port through Flood's API. Flood translates its client settings for whichever
+// backend it manages (rTorrent, qBittorrent, Transmission), so the backend's own RPC needn't be reachable.
+type Client struct {
+	host   string
+	port   int
+	user   string
+	pass   string
+	client *http.Client
+	Log    logging.Logger
+}
+
+type settings struct {
+	PortRange  string `json:"networkPortRange"`
+	PortRandom bool   `json:"networkPortRandom"`
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+}
+
+// user is empty when Flood runs with --auth none
+func NewClient(host string, port int, user string, pass string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "flood: "}
+	return &Client{
+		host:   host,
+		port:   port,
+		user:   user,
+		pass:   pass,
+		client: httpClient,
+		Log:    logger,
+	}
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d%s", c.host, c.port, path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	req.Header.Add("Accept", "application/json")
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	if c.user != "" {
+		if err := c.login(); err != nil {
+			return err
+		}
+		c.Log.Debug("login OK")
+	}
+
+	current, err := c.getSettings()
+	if err != nil {
+		return err
+	}
+	c.Log.Debug("getSettings OK %v", current)
+
+	want := fmt.Sprintf("%d-%d", port, port)
+	if current.PortRange == want && !current.PortRandom {
+		// nothing to do
+		c.Log.Info("Port is correct")
+		return nil
+	}
+
+	c.Log.Info("Pushing port %d, current port range is %s", port, current.PortRange)
+	if err := c.setSettings(&settings{PortRange: want, PortRandom: false}); err != nil {
+		return err
+	}
+	c.Log.Info("Port pushed")
+	return nil
+}
+
+// Flood answers with a jwt cookie that the cookie jar keeps for the following requests
+func (c *Client) login() error {
+	body, err := json.Marshal(map[string]string{"username": c.user, "password": c.pass})
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req, err := c.newRequest(http.MethodPost, "/api/auth/authenticate", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("login failed, check username and password")
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (c *Client) getSettings() (*settings, error) {
+	req, err := c.newRequest(http.MethodGet, "/api/client/settings", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response %s", err)
+	}
+	var s *settings
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal json: %s", err)
+	}
+	return s, nil
+}
+
+// Flood only changes the settings present in the body
+func (c *Client) setSettings(s *settings) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req, err := c.newRequest(http.MethodPatch, "/api/client/settings", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package flood
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process Flood with a single user
+type fakeFlood struct {
+	settings map[string]interface{}
+	patches  int
+}
+
+func (f *fakeFlood) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/auth/authenticate":
+		var creds map[string]string
+		json.NewDecoder(r.Body).Decode(&creds)
+		if creds["username"] != "flood" || creds["password"] != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "jwt", Value: "token", Path: "/api"})
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "username": "flood"})
+		return
+	}
+	if cookie, err := r.Cookie("jwt"); err != nil || cookie.Value != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/client/settings":
+		json.NewEncoder(w).Encode(f.settings)
+	case r.Method == http.MethodPatch && r.URL.Path == "/api/client/settings":
+		var changes map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&changes)
+		for k, v := range changes {
+			f.settings[k] = v
+		}
+		f.patches++
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestClient(t *testing.T, serverURL string, user string, pass string) *Client {
+	host, port := testutil.URLHostPort(t, serverURL)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(host, port, user, pass, &http.Client{Jar: jar}, logging.NewLogger(logging.ERROR))
+}
+
+func TestPush(t *testing.T) {
+	f := &fakeFlood{settings: map[string]interface{}{"networkPortRange": "6881-6889", "networkPortRandom": true, "dht": true}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "flood", "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.settings["networkPortRange"] != "44201-44201" || f.settings["networkPortRandom"] != false || f.settings["dht"] != true {
+		t.Errorf("Expected port range 44201-44201 without random, got %v", f.settings)
+	}
+
+	// already set, nothing is changed
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.patches != 1 {
+		t.Errorf("Expected a single settings change, got %d", f.patches)
+	}
+}
+
+func TestPushAuthRejected(t *testing.T) {
+	server := httptest.NewServer(&fakeFlood{})
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "flood", "wrong")
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error for rejected credentials")
+	}
+}
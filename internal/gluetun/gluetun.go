@@ -1,31 +1,112 @@
 package gluetun
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/source"
 )
 
+// Gluetun control server API generations, detected on first use and cached per client.
+type apiVersion int
+
+const (
+	apiUnknown apiVersion = iota
+	// Old images: OpenVPN only, /v1/openvpn/status and /v1/openvpn/portforwarded
+	apiLegacy
+	// /v1/vpn/status for both OpenVPN and WireGuard, port still at /v1/openvpn/portforwarded
+	apiVPNStatus
+	// /v1/vpn/status and /v1/portforward
+	apiUnified
+)
+
+func (v apiVersion) String() string {
+	switch v {
+	case apiLegacy:
+		return "legacy"
+	case apiVPNStatus:
+		return "vpn-status"
+	case apiUnified:
+		return "unified"
+	default:
+		return "unknown"
+	}
+}
+
+// Returned (wrapped) when Gluetun reports that the VPN isn't running
+var ErrNotRunning = errors.New("gluetun VPN is not running")
+
+// Returned when Gluetun answers port 0, port forwarding is unavailable or the VPN disconnected
+var ErrNoPort = errors.New("gluetun responded with port 0")
+
 type Client struct {
-	host   string
-	port   int
-	client *http.Client
-	Log    logging.Logger
+	host    string
+	port    int
+	apiKey  string
+	user    string
+	pass    string
+	client  *http.Client
+	Log     logging.Logger
+	api     apiVersion
+	vpnType string
+	remedy  *Remediator
 }
 
 // Stringer
 func (c *Client) String() string {
-	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+	return fmt.Sprintf("host=%s port=%d auth=%s", c.host, c.port, c.authKind())
+}
+
+func (c *Client) authKind() string {
+	switch {
+	case c.apiKey != "" && c.user != "":
+		return "apikey+basic"
+	case c.apiKey != "":
+		return "apikey"
+	case c.user != "":
+		return "basic"
+	default:
+		return "none"
+	}
 }
 
 type gtStatusResp struct {
 	Status string `json:"status"`
 }
 type gtPortResp struct {
-	Port int `json:"port"`
+	Port  int   `json:"port"`
+	Ports []int `json:"ports"`
+}
+
+// Ordered forwarded ports, newer images may report several in `ports`.
+func (r *gtPortResp) ports() []int {
+	ports := make([]int, 0, len(r.Ports)+1)
+	for _, p := range r.Ports {
+		if p != 0 {
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) == 0 && r.Port != 0 {
+		ports = append(ports, r.Port)
+	}
+	return ports
+}
+
+type gtPublicIPResp struct {
+	IP           string `json:"public_ip"`
+	Country      string `json:"country"`
+	Region       string `json:"region"`
+	City         string `json:"city"`
+	Organization string `json:"organization"`
+}
+
+type gtSettingsResp struct {
+	Type string `json:"type"`
 }
 
 func NewClient(host string, port int, httpClient *http.Client, logger logging.Logger) *Client {
@@ -44,84 +125,282 @@ func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request,
 		return nil, err
 	}
 	req.Header.Add("User-Agent", "Port Pusher")
+	if c.apiKey != "" {
+		req.Header.Add("X-API-Key", c.apiKey)
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
 	return req, nil
 }
 
-// Pull the current forwarded port from Gluetun.
-// Makes two calls to Gluetun: one to verify that it's running and a second to fetch the forwarded port.
-func (c Client) PullPort() (int, error) {
-	port, err := c.doPullPort()
+// Sends an API key in the X-API-Key header, for control server roles using `auth = "apikey"`.
+func (c *Client) SetAPIKey(apiKey string) {
+	c.apiKey = apiKey
+}
+
+// Sends HTTP basic auth credentials, for control server roles using `auth = "basic"`.
+func (c *Client) SetBasicAuth(user string, pass string) {
+	c.user = user
+	c.pass = pass
+}
+
+// Restarts the VPN when PullPorts keeps failing, see Remediator
+func (c *Client) SetRemediator(r *Remediator) {
+	c.remedy = r
+}
+
+// Pull the current forwarded ports from Gluetun, in the order Gluetun reports them.
+// Makes two calls to Gluetun: one to verify that it's running and a second to fetch the forwarded ports.
+// The first call on a client also detects which API generation Gluetun speaks.
+func (c *Client) PullPorts() ([]int, error) {
+	ports, err := c.doPullPorts()
 	if err != nil {
 		c.Log.Error("pull port error: %v", err)
-		return port, err
 	}
-	return port, err
+	if c.remedy != nil {
+		c.remedy.Observe(err)
+	}
+	return ports, err
+}
+
+// VPN type reported by Gluetun (openvpn or wireguard), empty until the API has been detected.
+func (c *Client) VPNType() string {
+	return c.vpnType
 }
 
-func (c Client) doPullPort() (int, error) {
+func (c *Client) doPullPorts() ([]int, error) {
+	if c.api == apiUnknown {
+		if err := c.detect(); err != nil {
+			return nil, err
+		}
+	}
+
 	// check that gtun is connected
-	req, err := c.newRequest(http.MethodGet, fmt.Sprintf("http://%s:%d/v1/openvpn/status", c.host, c.port), nil)
+	var statusResp *gtStatusResp
+	code, err := c.getJSON(c.statusPath(), &statusResp)
 	if err != nil {
-		return -1, fmt.Errorf("failed to build HTTP request %s", err)
+		return nil, fmt.Errorf("failed to fetch gluetun status: %w", err)
 	}
-	res, err := c.client.Do(req)
+	if code != http.StatusOK {
+		c.forget(code)
+		return nil, fmt.Errorf("failed to fetch gluetun status. HTTP status: %d", code)
+	}
+
+	if statusResp.Status != "running" {
+		return nil, fmt.Errorf("%w, status is %s, cannot fetch forwarded port", ErrNotRunning, statusResp.Status)
+	}
+
+	// fetch the forwarded port
+	var portResp *gtPortResp
+	code, err = c.getJSON(c.portPath(), &portResp)
 	if err != nil {
-		return -1, fmt.Errorf("failed to fetch gluetun status: %s", err)
+		return nil, fmt.Errorf("failed to fetch forwarded port: %w", err)
 	}
-	if res.StatusCode != http.StatusOK {
-		return -1, fmt.Errorf("failed to fetch gluetun status. HTTP status: %d", res.StatusCode)
+	if code != http.StatusOK {
+		c.forget(code)
+		return nil, fmt.Errorf("failed to fetch forwarded port. HTTP status: %d", code)
 	}
-	defer res.Body.Close()
-	data, err := io.ReadAll(res.Body)
+
+	// Gluetun may respond with 0 if port forwarding is not available or if it disconnects
+	ports := portResp.ports()
+	if len(ports) == 0 {
+		return nil, ErrNoPort
+	}
+
+	if len(ports) == 1 {
+		c.Log.Info("Forwarded port is %d", ports[0])
+	} else {
+		c.Log.Info("Forwarded ports are %v", ports)
+	}
+
+	return ports, nil
+}
+
+// Pull the public IP of the VPN session from Gluetun, along with the location Gluetun reports for it.
+func (c *Client) PullPublicIP() (*source.PublicIP, error) {
+	ip, err := c.doPullPublicIP()
 	if err != nil {
-		return -1, fmt.Errorf("error reading response %s", err)
+		c.Log.Error("pull public IP error: %v", err)
+		return nil, err
 	}
-	c.Log.Debug("status response: %s", string(data))
+	return ip, nil
+}
 
+func (c *Client) doPullPublicIP() (*source.PublicIP, error) {
+	var ip *gtPublicIPResp
+	code, err := c.getJSON("/v1/publicip/ip", &ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch public IP: %w", err)
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch public IP. HTTP status: %d", code)
+	}
+	// Gluetun responds with an empty IP until it has looked it up
+	if ip == nil || ip.IP == "" {
+		return nil, fmt.Errorf("gluetun has no public IP yet")
+	}
+	c.Log.Info("Public IP is %s (%s, %s)", ip.IP, ip.Country, ip.Region)
+	return &source.PublicIP{IP: ip.IP, Country: ip.Country, Region: ip.Region, City: ip.City, Organization: ip.Organization}, nil
+}
+
+// Cycles the VPN tunnel by setting its status to stopped and then back to running.
+func (c *Client) Restart() error {
+	if err := c.doRestart(); err != nil {
+		c.Log.Error("restart error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doRestart() error {
+	if c.api == apiUnknown {
+		if err := c.detect(); err != nil {
+			return err
+		}
+	}
+	for _, status := range []string{"stopped", "running"} {
+		c.Log.Info("Setting VPN status to %s", status)
+		if err := c.putStatus(status); err != nil {
+			return fmt.Errorf("failed to set VPN status to %s: %w", status, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) statusPath() string {
+	if c.api == apiLegacy {
+		return "/v1/openvpn/status"
+	}
+	return "/v1/vpn/status"
+}
+
+func (c *Client) portPath() string {
+	if c.api == apiUnified {
+		return "/v1/portforward"
+	}
+	return "/v1/openvpn/portforwarded"
+}
+
+// Works out which API generation Gluetun speaks by probing the newer routes.
+// Older images answer 404 for routes they don't know.
+func (c *Client) detect() error {
 	var statusResp *gtStatusResp
-	err = json.Unmarshal([]byte(data), &statusResp)
+	code, err := c.getJSON("/v1/vpn/status", &statusResp)
 	if err != nil {
-		return -1, fmt.Errorf("could not unmarshal json: %s", err)
+		return fmt.Errorf("failed to detect gluetun API: %w", err)
+	}
+	switch code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		c.api = apiLegacy
+		c.vpnType = "openvpn"
+		c.Log.Info("Detected %s API, VPN type is %s", c.api, c.vpnType)
+		return nil
+	default:
+		return fmt.Errorf("failed to detect gluetun API. HTTP status: %d", code)
 	}
 
-	if statusResp.Status != "running" {
-		return -1, fmt.Errorf("status is %s, cannot fetch forwarded port", statusResp.Status)
+	var portResp *gtPortResp
+	code, err = c.getJSON("/v1/portforward", &portResp)
+	if err != nil {
+		return fmt.Errorf("failed to detect gluetun API: %w", err)
+	}
+	switch code {
+	case http.StatusOK:
+		c.api = apiUnified
+	case http.StatusNotFound:
+		c.api = apiVPNStatus
+	default:
+		return fmt.Errorf("failed to detect gluetun API. HTTP status: %d", code)
 	}
 
-	// fetch the forwarded port
-	req, err = c.newRequest(http.MethodGet, fmt.Sprintf("http://%s:%d/v1/openvpn/portforwarded", c.host, c.port), nil)
+	// the VPN type is informational, don't fail if the settings can't be read
+	c.vpnType = "unknown"
+	var settingsResp *gtSettingsResp
+	code, err = c.getJSON("/v1/vpn/settings", &settingsResp)
 	if err != nil {
-		return -1, fmt.Errorf("failed to build HTTP request %s", err)
+		c.Log.Debug("could not fetch VPN settings: %v", err)
+	} else if code != http.StatusOK {
+		c.Log.Debug("could not fetch VPN settings, got HTTP %d", code)
+	} else if settingsResp != nil && settingsResp.Type != "" {
+		c.vpnType = settingsResp.Type
 	}
-	res, err = c.client.Do(req)
+	c.Log.Info("Detected %s API, VPN type is %s", c.api, c.vpnType)
+	return nil
+}
+
+// A 404 on a route we detected means Gluetun was replaced by a different image, detect again on the next pull.
+func (c *Client) forget(code int) {
+	if code == http.StatusNotFound {
+		c.api = apiUnknown
+		c.vpnType = ""
+	}
+}
+
+// GETs a path from the control server and unmarshals the body into v when the response is HTTP 200.
+// The HTTP status is returned so callers can tell missing routes apart from other failures.
+// HTTP 401 and 403 are reported as source.ErrAuthRejected.
+func (c *Client) getJSON(path string, v any) (int, error) {
+	req, err := c.newRequest(http.MethodGet, fmt.Sprintf("http://%s:%d%s", c.host, c.port, path), nil)
 	if err != nil {
-		return -1, fmt.Errorf("failed to fetch forwarded port: %s", err)
+		return 0, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return res.StatusCode, fmt.Errorf("%w, got HTTP %d", source.ErrAuthRejected, res.StatusCode)
+	}
 	if res.StatusCode != http.StatusOK {
-		return -1, fmt.Errorf("failed to fetch forwarded port. HTTP status: %d", res.StatusCode)
+		return res.StatusCode, nil
 	}
 
-	defer res.Body.Close()
-	data, err = io.ReadAll(res.Body)
+	data, err := io.ReadAll(res.Body)
 	if err != nil {
-		return -1, fmt.Errorf("error reading response %s", err)
+		return res.StatusCode, fmt.Errorf("error reading response %s", err)
 	}
-	c.Log.Debug("portforwarded response: %s", string(data))
+	c.Log.Debug("%s response: %s", path, string(data))
 
-	var portResp *gtPortResp
-	err = json.Unmarshal([]byte(data), &portResp)
+	err = json.Unmarshal(data, v)
 	if err != nil {
-		return -1, fmt.Errorf("could not unmarshal json: %s", err)
+		return res.StatusCode, fmt.Errorf("could not unmarshal json: %s", err)
 	}
+	return res.StatusCode, nil
+}
 
-	// Gluetun may respond with 0 if port forwarding is not available or if it disconnects
-	if portResp.Port == 0 {
-		return -1, fmt.Errorf("gluetun responded with port 0")
+// PUTs a new VPN status to the control server. Gluetun answers once the change is done.
+func (c *Client) putStatus(status string) error {
+	out, err := json.Marshal(gtStatusResp{Status: status})
+	if err != nil {
+		return fmt.Errorf("failed to marshal HTTP body %s", err)
 	}
+	req, err := c.newRequest(http.MethodPut, fmt.Sprintf("http://%s:%d%s", c.host, c.port, c.statusPath()), bytes.NewBuffer(out))
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
 
-	c.Log.Info("Forwarded port is %d", portResp.Port)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
 
-	return portResp.Port, nil
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w, got HTTP %d", source.ErrAuthRejected, res.StatusCode)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response %s", err)
+	}
+	c.Log.Debug("%s PUT response: %s", c.statusPath(), string(data))
+	return nil
 }
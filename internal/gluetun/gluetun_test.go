@@ -0,0 +1,295 @@
+package gluetun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/source"
+)
+
+// Fake Gluetun control server. Only the routes in the map are served, everything else is a 404.
+type fakeGluetun struct {
+	routes map[string]string
+	hits   map[string]int
+	authOK func(r *http.Request) bool
+	puts   []string
+}
+
+func (f *fakeGluetun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.hits[r.URL.Path]++
+	if f.authOK != nil && !f.authOK(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, ok := f.routes[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPut {
+		data, _ := io.ReadAll(r.Body)
+		f.puts = append(f.puts, r.URL.Path+" "+string(data))
+		fmt.Fprint(w, `{"outcome":"ok"}`)
+		return
+	}
+	fmt.Fprint(w, body)
+}
+
+func newTestClient(t *testing.T, routes map[string]string) (*Client, *fakeGluetun) {
+	fake := &fakeGluetun{routes: routes, hits: map[string]int{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	return NewClient(host, port, srv.Client(), logging.NewLogger(logging.ERROR)), fake
+}
+
+func TestPullPortLegacy(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/openvpn/status":        `{"status":"running"}`,
+		"/v1/openvpn/portforwarded": `{"port":44201}`,
+	})
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 44201 {
+		t.Errorf("Expected port 44201, got %v", ports)
+	}
+	if c.api != apiLegacy || c.VPNType() != "openvpn" {
+		t.Errorf("Expected legacy openvpn, got %s %s", c.api, c.VPNType())
+	}
+	if fake.hits["/v1/vpn/status"] != 1 {
+		t.Errorf("Expected a single probe of /v1/vpn/status, got %d", fake.hits["/v1/vpn/status"])
+	}
+}
+
+func TestPullPortVPNStatus(t *testing.T) {
+	c, _ := newTestClient(t, map[string]string{
+		"/v1/vpn/status":            `{"status":"running"}`,
+		"/v1/vpn/settings":          `{"type":"wireguard"}`,
+		"/v1/openvpn/status":        `{"status":"stopped"}`,
+		"/v1/openvpn/portforwarded": `{"port":51820}`,
+	})
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 51820 {
+		t.Errorf("Expected port 51820, got %v", ports)
+	}
+	if c.api != apiVPNStatus || c.VPNType() != "wireguard" {
+		t.Errorf("Expected vpn-status wireguard, got %s %s", c.api, c.VPNType())
+	}
+}
+
+func TestPullPortUnified(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/vpn/status":   `{"status":"running"}`,
+		"/v1/vpn/settings": `{"type":"wireguard"}`,
+		"/v1/portforward":  `{"port":60123}`,
+	})
+	for i := 0; i < 2; i++ {
+		ports, err := c.PullPorts()
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if len(ports) != 1 || ports[0] != 60123 {
+			t.Errorf("Expected port 60123, got %v", ports)
+		}
+	}
+	if c.api != apiUnified || c.VPNType() != "wireguard" {
+		t.Errorf("Expected unified wireguard, got %s %s", c.api, c.VPNType())
+	}
+	// detection is cached, settings are only read once
+	if fake.hits["/v1/vpn/settings"] != 1 {
+		t.Errorf("Expected settings to be read once, got %d", fake.hits["/v1/vpn/settings"])
+	}
+}
+
+func TestPullPortNotRunning(t *testing.T) {
+	c, _ := newTestClient(t, map[string]string{
+		"/v1/vpn/status":  `{"status":"stopped"}`,
+		"/v1/portforward": `{"port":0}`,
+	})
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error when VPN is stopped")
+	}
+	if c.VPNType() != "unknown" {
+		t.Errorf("Expected unknown VPN type without settings route, got %s", c.VPNType())
+	}
+}
+
+func TestPullPortZero(t *testing.T) {
+	c, _ := newTestClient(t, map[string]string{
+		"/v1/vpn/status":  `{"status":"running"}`,
+		"/v1/portforward": `{"port":0}`,
+	})
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error for port 0")
+	}
+}
+
+func TestPullPortRedetect(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/vpn/status":  `{"status":"running"}`,
+		"/v1/portforward": `{"port":60123}`,
+	})
+	if _, err := c.PullPorts(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	// container swapped for an old image
+	fake.routes = map[string]string{
+		"/v1/openvpn/status":        `{"status":"running"}`,
+		"/v1/openvpn/portforwarded": `{"port":44201}`,
+	}
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error after routes disappeared")
+	}
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 44201 || c.api != apiLegacy {
+		t.Errorf("Expected legacy port 44201, got %s %v", c.api, ports)
+	}
+}
+
+func TestPullPortAPIKey(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/vpn/status":  `{"status":"running"}`,
+		"/v1/portforward": `{"port":60123}`,
+	})
+	fake.authOK = func(r *http.Request) bool {
+		return r.Header.Get("X-API-Key") == "secret"
+	}
+
+	_, err := c.PullPorts()
+	if !errors.Is(err, source.ErrAuthRejected) {
+		t.Errorf("Expected ErrAuthRejected without credentials, got %v", err)
+	}
+
+	c.SetAPIKey("secret")
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 60123 {
+		t.Errorf("Expected port 60123, got %v", ports)
+	}
+}
+
+func TestPullPortBasicAuth(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/vpn/status":  `{"status":"running"}`,
+		"/v1/portforward": `{"port":60123}`,
+	})
+	fake.authOK = func(r *http.Request) bool {
+		user, pass, ok := r.BasicAuth()
+		return ok && user == "admin" && pass == "secret"
+	}
+
+	c.SetBasicAuth("admin", "wrong")
+	_, err := c.PullPorts()
+	if !errors.Is(err, source.ErrAuthRejected) {
+		t.Errorf("Expected ErrAuthRejected with bad password, got %v", err)
+	}
+
+	c.SetBasicAuth("admin", "secret")
+	if _, err := c.PullPorts(); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestPullPortsMultiple(t *testing.T) {
+	c, _ := newTestClient(t, map[string]string{
+		"/v1/vpn/status":  `{"status":"running"}`,
+		"/v1/portforward": `{"port":60123,"ports":[60123,60124,60125]}`,
+	})
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 3 || ports[0] != 60123 || ports[1] != 60124 || ports[2] != 60125 {
+		t.Errorf("Expected ports [60123 60124 60125], got %v", ports)
+	}
+}
+
+func TestPullPortsSentinelErrors(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/vpn/status":  `{"status":"stopped"}`,
+		"/v1/portforward": `{"port":0}`,
+	})
+	if _, err := c.PullPorts(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning, got %v", err)
+	}
+	fake.routes["/v1/vpn/status"] = `{"status":"running"}`
+	if _, err := c.PullPorts(); !errors.Is(err, ErrNoPort) {
+		t.Errorf("Expected ErrNoPort, got %v", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/vpn/status":  `{"status":"running"}`,
+		"/v1/portforward": `{"port":0}`,
+	})
+	if err := c.Restart(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	expected := []string{
+		`/v1/vpn/status {"status":"stopped"}`,
+		`/v1/vpn/status {"status":"running"}`,
+	}
+	if len(fake.puts) != len(expected) || fake.puts[0] != expected[0] || fake.puts[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, fake.puts)
+	}
+}
+
+func TestRestartLegacy(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/openvpn/status":        `{"status":"running"}`,
+		"/v1/openvpn/portforwarded": `{"port":0}`,
+	})
+	if err := c.Restart(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(fake.puts) != 2 || fake.puts[0] != `/v1/openvpn/status {"status":"stopped"}` {
+		t.Errorf("Expected restart through /v1/openvpn/status, got %v", fake.puts)
+	}
+}
+
+func TestPullPublicIP(t *testing.T) {
+	c, fake := newTestClient(t, map[string]string{
+		"/v1/publicip/ip": `{"public_ip":"","region":"","country":""}`,
+	})
+	if _, err := c.PullPublicIP(); err == nil {
+		t.Errorf("Expected error for an empty public IP")
+	}
+
+	fake.routes["/v1/publicip/ip"] = `{"public_ip":"203.0.113.7","region":"North Holland","country":"Netherlands","city":"Amsterdam"}`
+	ip, err := c.PullPublicIP()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if ip.IP != "203.0.113.7" || ip.Country != "Netherlands" || ip.Region != "North Holland" {
+		t.Errorf("Unexpected public IP %v", ip)
+	}
+}
@@ -0,0 +1,88 @@
+package gluetun
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// When to cycle the VPN tunnel after port forwarding keeps failing.
+type RemediationPolicy struct {
+	// Consecutive zero-port or not-running results before restarting
+	Threshold int
+	// The consecutive results must all fall within this window
+	Window time.Duration
+	// Minimum time between two restarts
+	Cooldown time.Duration
+	// Maximum restarts in any 24 hour period
+	MaxPerDay int
+}
+
+type restarter interface {
+	Restart() error
+}
+
+// Watches PullPorts results and restarts the VPN through the control server when the policy says so.
+type Remediator struct {
+	policy   RemediationPolicy
+	client   restarter
+	Log      logging.Logger
+	now      func() time.Time
+	failures []time.Time // consecutive failures, oldest first
+	restarts []time.Time // restart attempts in the last 24 hours, oldest first
+}
+
+func NewRemediator(policy RemediationPolicy, client *Client, logger logging.Logger) *Remediator {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "gluetun: "}
+	return &Remediator{
+		policy: policy,
+		client: client,
+		Log:    logger,
+		now:    time.Now,
+	}
+}
+
+// Records the result of a PullPorts call and restarts the VPN if the policy threshold is reached.
+// Returns true when a restart was attempted.
+func (r *Remediator) Observe(err error) bool {
+	if err == nil || !(errors.Is(err, ErrNotRunning) || errors.Is(err, ErrNoPort)) {
+		r.failures = r.failures[:0]
+		return false
+	}
+
+	now := r.now()
+	r.failures = append(r.failures, now)
+	// only failures inside the window count
+	for len(r.failures) > 0 && now.Sub(r.failures[0]) > r.policy.Window {
+		r.failures = r.failures[1:]
+	}
+	if len(r.failures) < r.policy.Threshold {
+		r.Log.Debug("port forwarding failure %d of %d", len(r.failures), r.policy.Threshold)
+		return false
+	}
+
+	for len(r.restarts) > 0 && now.Sub(r.restarts[0]) >= 24*time.Hour {
+		r.restarts = r.restarts[1:]
+	}
+	if len(r.restarts) > 0 {
+		last := r.restarts[len(r.restarts)-1]
+		if wait := r.policy.Cooldown - now.Sub(last); wait > 0 {
+			r.Log.Warn("Port forwarding failed %d times, VPN restart is cooling down for %v", len(r.failures), wait.Round(time.Second))
+			return false
+		}
+	}
+	if len(r.restarts) >= r.policy.MaxPerDay {
+		r.Log.Warn("Port forwarding failed %d times, VPN already restarted %d times in the last 24h", len(r.failures), len(r.restarts))
+		return false
+	}
+
+	r.restarts = append(r.restarts, now)
+	r.Log.Warn("Port forwarding failed %d times in %v, restarting VPN (attempt %d of %d today)", len(r.failures), now.Sub(r.failures[0]).Round(time.Second), len(r.restarts), r.policy.MaxPerDay)
+	r.failures = r.failures[:0]
+	if err := r.client.Restart(); err != nil {
+		return true
+	}
+	r.Log.Info("VPN restarted")
+	return true
+}
@@ -0,0 +1,99 @@
+package gluetun
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/source"
+)
+
+type fakeRestarter struct {
+	restarts int
+}
+
+func (f *fakeRestarter) Restart() error {
+	f.restarts++
+	return nil
+}
+
+func newTestRemediator(policy RemediationPolicy) (*Remediator, *fakeRestarter, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := &fakeRestarter{}
+	r := NewRemediator(policy, nil, logging.NewLogger(logging.ERROR))
+	r.client = fake
+	r.now = func() time.Time { return now }
+	return r, fake, &now
+}
+
+func TestRemediatorThreshold(t *testing.T) {
+	r, fake, now := newTestRemediator(RemediationPolicy{Threshold: 3, Window: time.Hour, Cooldown: time.Hour, MaxPerDay: 5})
+
+	for i := 0; i < 2; i++ {
+		if r.Observe(ErrNoPort) {
+			t.Errorf("Unexpected restart after %d failures", i+1)
+		}
+		*now = now.Add(5 * time.Minute)
+	}
+	// a success breaks the streak
+	r.Observe(nil)
+	for i := 0; i < 2; i++ {
+		r.Observe(ErrNoPort)
+		*now = now.Add(5 * time.Minute)
+	}
+	if fake.restarts != 0 {
+		t.Fatalf("Expected no restarts, got %d", fake.restarts)
+	}
+	if !r.Observe(ErrNotRunning) {
+		t.Errorf("Expected restart after 3 consecutive failures")
+	}
+	if fake.restarts != 1 {
+		t.Errorf("Expected 1 restart, got %d", fake.restarts)
+	}
+}
+
+func TestRemediatorIgnoresOtherErrors(t *testing.T) {
+	r, fake, _ := newTestRemediator(RemediationPolicy{Threshold: 1, Window: time.Hour, Cooldown: time.Hour, MaxPerDay: 5})
+	r.Observe(errors.New("connection refused"))
+	r.Observe(source.ErrAuthRejected)
+	if fake.restarts != 0 {
+		t.Errorf("Expected no restarts, got %d", fake.restarts)
+	}
+}
+
+func TestRemediatorWindow(t *testing.T) {
+	r, fake, now := newTestRemediator(RemediationPolicy{Threshold: 3, Window: 20 * time.Minute, Cooldown: time.Hour, MaxPerDay: 5})
+	for i := 0; i < 5; i++ {
+		r.Observe(ErrNoPort)
+		*now = now.Add(15 * time.Minute)
+	}
+	if fake.restarts != 0 {
+		t.Errorf("Expected failures outside the window to be ignored, got %d restarts", fake.restarts)
+	}
+}
+
+func TestRemediatorCooldownAndDailyLimit(t *testing.T) {
+	r, fake, now := newTestRemediator(RemediationPolicy{Threshold: 1, Window: time.Hour, Cooldown: time.Hour, MaxPerDay: 2})
+
+	r.Observe(ErrNoPort)
+	*now = now.Add(30 * time.Minute)
+	if r.Observe(ErrNoPort) {
+		t.Errorf("Expected no restart during cooldown")
+	}
+	*now = now.Add(31 * time.Minute)
+	r.Observe(ErrNoPort)
+	*now = now.Add(2 * time.Hour)
+	if r.Observe(ErrNoPort) {
+		t.Errorf("Expected daily limit to prevent a third restart")
+	}
+	if fake.restarts != 2 {
+		t.Errorf("Expected 2 restarts, got %d", fake.restarts)
+	}
+
+	// the oldest restart ages out after 24 hours
+	*now = now.Add(22 * time.Hour)
+	if !r.Observe(ErrNoPort) {
+		t.Errorf("Expected restart once the daily limit allows it")
+	}
+}
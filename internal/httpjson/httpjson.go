@@ -0,0 +1,183 @@
+package httpjson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nanreh/portpusher/internal/jsonpath"
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/ports"
+	"github.com/nanreh/portpusher/internal/source"
+)
+
+// Returned (wrapped) when the ready flag in the response isn't set
+var ErrNotReady = errors.New("not ready")
+
+// Pulls the forwarded port from any HTTP endpoint that answers JSON, e.g. a VPN sidecar that isn't Gluetun.
+type Client struct {
+	url        string
+	method     string
+	body       string
+	headers    http.Header
+	user       string
+	pass       string
+	token      string
+	portPath   *jsonpath.Path
+	readyPath  *jsonpath.Path
+	readyValue string
+	client     *http.Client
+	Log        logging.Logger
+}
+
+// Stringer
+func (c *Client) String() string {
+	ready := "none"
+	if c.readyPath != nil {
+		ready = fmt.Sprintf("%s==%s", c.readyPath, c.readyValue)
+	}
+	return fmt.Sprintf("url=%s method=%s port=%s ready=%s auth=%s", c.url, c.method, c.portPath, ready, c.authKind())
+}
+
+func (c *Client) authKind() string {
+	switch {
+	case c.token != "":
+		return "bearer"
+	case c.user != "":
+		return "basic"
+	default:
+		return "none"
+	}
+}
+
+func NewClient(url string, method string, portPath *jsonpath.Path, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "http: "}
+	return &Client{
+		url:      url,
+		method:   method,
+		headers:  http.Header{},
+		portPath: portPath,
+		client:   httpClient,
+		Log:      logger,
+	}
+}
+
+// Request body, sent as JSON with either method, GET included
+func (c *Client) SetBody(body string) {
+	c.body = body
+}
+
+func (c *Client) AddHeader(name string, value string) {
+	c.headers.Add(name, value)
+}
+
+func (c *Client) SetBasicAuth(user string, pass string) {
+	c.user = user
+	c.pass = pass
+}
+
+func (c *Client) SetBearerToken(token string) {
+	c.token = token
+}
+
+// Only report a port when the value at path, formatted as text, equals value (e.g. "true" or "connected")
+func (c *Client) SetReady(path *jsonpath.Path, value string) {
+	c.readyPath = path
+	c.readyValue = value
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	for name, values := range c.headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.user != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+	return req, nil
+}
+
+// Pull the current forwarded ports from the endpoint
+func (c *Client) PullPorts() ([]int, error) {
+	ports, err := c.doPullPorts()
+	if err != nil {
+		c.Log.Error("pull port error: %v", err)
+		return ports, err
+	}
+	return ports, err
+}
+
+func (c *Client) doPullPorts() ([]int, error) {
+	var body io.Reader
+	if c.body != "" {
+		body = strings.NewReader(c.body)
+	}
+	req, err := c.newRequest(c.method, c.url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch forwarded port: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w, got HTTP %d", source.ErrAuthRejected, res.StatusCode)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch forwarded port. HTTP status: %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response %s", err)
+	}
+	c.Log.Debug("response: %s", string(data))
+
+	var doc interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("could not unmarshal json: %s", err)
+	}
+
+	if c.readyPath != nil {
+		v, err := c.readyPath.Get(doc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrNotReady, err)
+		}
+		if fmt.Sprint(v) != c.readyValue {
+			return nil, fmt.Errorf("%w, %s is %v", ErrNotReady, c.readyPath, v)
+		}
+	}
+
+	v, err := c.portPath.Get(doc)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := ports.FromJSON(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.portPath, err)
+	}
+
+	if len(ports) == 1 {
+		c.Log.Info("Forwarded port is %d", ports[0])
+	} else {
+		c.Log.Info("Forwarded ports are %v", ports)
+	}
+	return ports, nil
+}
@@ -0,0 +1,86 @@
+package httpjson
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/jsonpath"
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/source"
+)
+
+func mustCompile(t *testing.T, expr string) *jsonpath.Path {
+	p, err := jsonpath.Compile(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPullPorts(t *testing.T) {
+	status := "connected"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"query":"pf"}` || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"vpn":{"state":"%s"},"forwarding":[{"port":51413},{"port":51414}]}`, status)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, http.MethodPost, mustCompile(t, "$.forwarding[*].port"), srv.Client(), logging.NewLogger(logging.ERROR))
+	c.SetBody(`{"query":"pf"}`)
+	c.SetReady(mustCompile(t, "$.vpn.state"), "connected")
+
+	if _, err := c.PullPorts(); !errors.Is(err, source.ErrAuthRejected) {
+		t.Errorf("Expected ErrAuthRejected, got %v", err)
+	}
+
+	c.AddHeader("X-Api-Key", "secret")
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 2 || ports[0] != 51413 || ports[1] != 51414 {
+		t.Errorf("Expected [51413 51414], got %v", ports)
+	}
+
+	status = "connecting"
+	if _, err := c.PullPorts(); !errors.Is(err, ErrNotReady) {
+		t.Errorf("Expected ErrNotReady, got %v", err)
+	}
+}
+
+func TestPullPortsBearer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"port":"44201"}`)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, http.MethodGet, mustCompile(t, "$.port"), srv.Client(), logging.NewLogger(logging.ERROR))
+	c.SetBearerToken("abc")
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 44201 {
+		t.Errorf("Expected [44201], got %v", ports)
+	}
+}
@@ -0,0 +1,142 @@
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A compiled JSONPath-style expression. The supported subset is enough to point at a value in an API response:
+//
+//	$.port             object key
+//	$.data['port']     bracketed key
+//	$.ports[0]         array index, negative counts from the end
+//	$.ports[*]         every array element or object value (object values in no particular order)
+//
+// Recursive descent ($..port) and filters are not supported.
+type Path struct {
+	expr  string
+	steps []step
+}
+
+type step struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Stringer
+func (p *Path) String() string {
+	return p.expr
+}
+
+func Compile(expr string) (*Path, error) {
+	p := &Path{expr: expr}
+	rest := strings.TrimSpace(expr)
+	rest = strings.TrimPrefix(rest, "$")
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			if strings.HasPrefix(rest, ".") {
+				return nil, fmt.Errorf("%s: recursive descent is not supported", expr)
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if name == "" {
+				return nil, fmt.Errorf("%s: empty key", expr)
+			}
+			if name == "*" {
+				p.steps = append(p.steps, step{wildcard: true})
+			} else {
+				p.steps = append(p.steps, step{key: name})
+			}
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("%s: missing ]", expr)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				p.steps = append(p.steps, step{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				p.steps = append(p.steps, step{key: inner[1 : len(inner)-1]})
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid index %s", expr, inner)
+				}
+				p.steps = append(p.steps, step{index: i, isIndex: true})
+			}
+		default:
+			// a bare leading key, e.g. "port" instead of "$.port"
+			if len(p.steps) == 0 {
+				rest = "." + rest
+				continue
+			}
+			return nil, fmt.Errorf("%s: unexpected %q", expr, rest[0])
+		}
+	}
+	return p, nil
+}
+
+// Returns the value the path points at in a document decoded by encoding/json.
+// Paths with a wildcard return every match as a []interface{}.
+func (p *Path) Get(doc interface{}) (interface{}, error) {
+	nodes := []interface{}{doc}
+	multi := false
+	for _, s := range p.steps {
+		if s.wildcard {
+			multi = true
+		}
+		next := make([]interface{}, 0, len(nodes))
+		for _, n := range nodes {
+			switch {
+			case s.wildcard:
+				switch t := n.(type) {
+				case []interface{}:
+					next = append(next, t...)
+				case map[string]interface{}:
+					for _, v := range t {
+						next = append(next, v)
+					}
+				}
+			case s.isIndex:
+				arr, ok := n.([]interface{})
+				if !ok {
+					continue
+				}
+				i := s.index
+				if i < 0 {
+					i += len(arr)
+				}
+				if i >= 0 && i < len(arr) {
+					next = append(next, arr[i])
+				}
+			default:
+				obj, ok := n.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if v, ok := obj[s.key]; ok {
+					next = append(next, v)
+				}
+			}
+		}
+		nodes = next
+	}
+	if multi {
+		return nodes, nil
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%s not found", p.expr)
+	}
+	return nodes[0], nil
+}
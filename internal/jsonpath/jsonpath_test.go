@@ -0,0 +1,63 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{"status":"connected","data":{"port":44201,"ports":[44201,44202],"peers":[{"port":1},{"port":2}]}}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"$.status", "connected"},
+		{"status", "connected"},
+		{"$.data.port", "44201"},
+		{"$['data']['port']", "44201"},
+		{"$.data.ports[1]", "44202"},
+		{"$.data.ports[-1]", "44202"},
+		{"$.data.ports[*]", "[44201 44202]"},
+		{"$.data.peers[*].port", "[1 2]"},
+		{"$.data.missing[*]", "[]"},
+	}
+	for _, test := range tests {
+		p, err := Compile(test.expr)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.expr, err)
+			continue
+		}
+		v, err := p.Get(doc)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.expr, err)
+			continue
+		}
+		if fmt.Sprint(v) != test.expected {
+			t.Errorf("%s: expected %s, got %v", test.expr, test.expected, v)
+		}
+	}
+
+	for _, expr := range []string{"$.data.missing", "$.data.ports[5]", "$.status.port"} {
+		p, err := Compile(expr)
+		if err != nil {
+			t.Errorf("%s: got error %v", expr, err)
+			continue
+		}
+		if v, err := p.Get(doc); err == nil {
+			t.Errorf("%s: expected error, got %v", expr, v)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{"$..port", "$.ports[", "$.ports[x]", "$.", "$.ports[0]x"} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
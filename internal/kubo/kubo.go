@@ -0,0 +1,206 @@
+package kubo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/command"
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// The config keys whose multiaddrs carry the swarm port
+var addressKeys = []string{"Addresses.Swarm", "Addresses.Announce"}
+
+// Multiaddr protocols without a value, every other protocol is followed by one
+var flagProtocols = map[string]bool{
+	"quic": true, "quic-v1": true, "webtransport": true, "webrtc": true, "webrtc-direct": true,
+	"ws": true, "wss": true, "tls": true, "noise": true, "http": true, "https": true,
+	"p2p-circuit": true, "utp": true, "udt": true, "p2p-webrtc-direct": true, "p2p-webrtc-star": true,
+}
+
+// Pushes the port into the tcp and udp multiaddrs of a Kubo (IPFS) node through its RPC API.
+// Kubo only listens on a new swarm port after a restart, see SetRestartCommand.
+type Client struct {
+	host           string
+	port           int
+	client         *http.Client
+	Log            logging.Logger
+	restartCommand string
+	restartTimeout time.Duration
+	// set when the config changed and Kubo hasn't been restarted since
+	restartPending bool
+}
+
+type configResponse struct {
+	Key   string   `json:"Key"`
+	Value []string `json:"Value"`
+}
+
+// Stringer
+func (c *Client) String() string {
+	restart := "none"
+	if c.restartCommand != "" {
+		restart = strconv.Quote(c.restartCommand)
+	}
+	return fmt.Sprintf("host=%s port=%d restart=%s", c.host, c.port, restart)
+}
+
+func NewClient(host string, port int, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "kubo: "}
+	return &Client{
+		host:   host,
+		port:   port,
+		client: httpClient,
+		Log:    logger,
+	}
+}
+
+// Runs a command with /bin/sh -c after the port changed, e.g. `docker restart ipfs`
+func (c *Client) SetRestartCommand(command string, timeout time.Duration) {
+	c.restartCommand = command
+	c.restartTimeout = timeout
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	changed := false
+	for _, key := range addressKeys {
+		addrs, err := c.getConfig(key)
+		if err != nil {
+			return fmt.Errorf("get %s failed: %s", key, err)
+		}
+		c.Log.Debug("get %s OK %v", key, addrs)
+
+		rewritten, found := rewriteMultiaddrs(addrs, port)
+		if found == 0 && key == "Addresses.Swarm" {
+			return fmt.Errorf("no tcp or udp multiaddr in %s", key)
+		}
+		if slices.Equal(rewritten, addrs) {
+			continue
+		}
+
+		c.Log.Info("Pushing port %d, current %s is %s", port, key, strings.Join(addrs, ", "))
+		if err := c.setConfig(key, rewritten); err != nil {
+			return fmt.Errorf("push failed: %s", err)
+		}
+		changed = true
+	}
+
+	if changed {
+		c.Log.Info("Port pushed")
+		if c.restartCommand == "" {
+			c.Log.Warn("Restart Kubo to listen on port %d", port)
+			return nil
+		}
+		c.restartPending = true
+	} else if !c.restartPending {
+		// nothing to do
+		c.Log.Info("Port is correct")
+		return nil
+	}
+
+	// a failed restart is retried on the next push, the config already has the port by then
+	c.Log.Info("Restarting Kubo")
+	if _, err := command.Run(c.restartCommand, c.restartTimeout, c.Log); err != nil {
+		return fmt.Errorf("restart failed: %w", err)
+	}
+	c.restartPending = false
+	return nil
+}
+
+// Sets the port of every tcp and udp component, e.g. /ip4/0.0.0.0/tcp/4001 or /ip6/::/udp/4001/quic-v1.
+// Returns the new multiaddrs and how many of them have a tcp or udp component.
+func rewriteMultiaddrs(addrs []string, port int) ([]string, int) {
+	rewritten := make([]string, len(addrs))
+	found := 0
+	for i, addr := range addrs {
+		parts := strings.Split(addr, "/")
+		matched := false
+		// parts[0] is the empty string before the leading slash
+		for j := 1; j < len(parts); j++ {
+			protocol := parts[j]
+			if flagProtocols[protocol] {
+				continue
+			}
+			if (protocol == "tcp" || protocol == "udp") && j+1 < len(parts) {
+				parts[j+1] = strconv.Itoa(port)
+				matched = true
+			}
+			j++ // skip the value
+		}
+		if matched {
+			found++
+		}
+		rewritten[i] = strings.Join(parts, "/")
+	}
+	return rewritten, found
+}
+
+func (c *Client) getConfig(key string) ([]string, error) {
+	res, err := c.config(url.Values{"arg": {key}})
+	if err != nil {
+		return nil, err
+	}
+	return res.Value, nil
+}
+
+func (c *Client) setConfig(key string, addrs []string) error {
+	value, err := json.Marshal(addrs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value %s", err)
+	}
+	_, err = c.config(url.Values{"arg": {key, string(value)}, "json": {"true"}})
+	return err
+}
+
+// Kubo's RPC API only accepts POST
+func (c *Client) config(query url.Values) (*configResponse, error) {
+	uri := fmt.Sprintf("http://%s:%d/api/v0/config?%s", c.host, c.port, query.Encode())
+	req, err := http.NewRequest(http.MethodPost, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response %s", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		// errors come as {"Message": "...", "Code": 0, "Type": "error"}
+		var kuboErr struct {
+			Message string `json:"Message"`
+		}
+		if json.Unmarshal(data, &kuboErr) == nil && kuboErr.Message != "" {
+			return nil, fmt.Errorf("HTTP request error, got HTTP %d: %s", res.StatusCode, kuboErr.Message)
+		}
+		return nil, fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+
+	var cfg *configResponse
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("could not unmarshal json: %s", err)
+	}
+	return cfg, nil
+}
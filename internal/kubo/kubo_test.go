@@ -0,0 +1,167 @@
+package kubo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process Kubo config RPC
+type fakeKubo struct {
+	config map[string][]string
+	sets   int
+}
+
+func (f *fakeKubo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path != "/api/v0/config" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	args := r.URL.Query()["arg"]
+	value, ok := f.config[args[0]]
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Message": "failed to get config value: key has no attributes", "Code": 0, "Type": "error"})
+		return
+	}
+	if len(args) == 2 {
+		if r.URL.Query().Get("json") != "true" || json.Unmarshal([]byte(args[1]), &value) != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.config[args[0]] = value
+		f.sets++
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"Key": args[0], "Value": value})
+}
+
+func newTestClient(t *testing.T, serverURL string) *Client {
+	host, port := testutil.URLHostPort(t, serverURL)
+	return NewClient(host, port, http.DefaultClient, logging.NewLogger(logging.ERROR))
+}
+
+func TestPush(t *testing.T) {
+	f := &fakeKubo{config: map[string][]string{
+		"Addresses.Swarm":    {"/ip4/0.0.0.0/tcp/4001", "/ip6/::/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1", "/ip4/0.0.0.0/udp/4001/quic-v1/webtransport"},
+		"Addresses.Announce": {"/ip4/203.0.113.7/tcp/4001", "/dns4/ipfs.example.com/tcp/4001/p2p/12D3KooWabc"},
+	}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	marker := filepath.Join(t.TempDir(), "restarted")
+	c := newTestClient(t, server.URL)
+	c.SetRestartCommand("touch "+marker, 5*time.Second)
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	expectedSwarm := []string{"/ip4/0.0.0.0/tcp/44201", "/ip6/::/tcp/44201", "/ip4/0.0.0.0/udp/44201/quic-v1", "/ip4/0.0.0.0/udp/44201/quic-v1/webtransport"}
+	if !slices.Equal(f.config["Addresses.Swarm"], expectedSwarm) {
+		t.Errorf("Expected %v, got %v", expectedSwarm, f.config["Addresses.Swarm"])
+	}
+	expectedAnnounce := []string{"/ip4/203.0.113.7/tcp/44201", "/dns4/ipfs.example.com/tcp/44201/p2p/12D3KooWabc"}
+	if !slices.Equal(f.config["Addresses.Announce"], expectedAnnounce) {
+		t.Errorf("Expected %v, got %v", expectedAnnounce, f.config["Addresses.Announce"])
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Expected the restart command to run")
+	}
+
+	// already set, nothing is changed and Kubo isn't restarted
+	os.Remove(marker)
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.sets != 2 {
+		t.Errorf("Expected two config changes, got %d", f.sets)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("Expected no restart when the port is correct")
+	}
+}
+
+func TestPushRestartFails(t *testing.T) {
+	f := &fakeKubo{config: map[string][]string{
+		"Addresses.Swarm":    {"/ip4/0.0.0.0/tcp/4001"},
+		"Addresses.Announce": {},
+	}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	runs := filepath.Join(t.TempDir(), "runs")
+	c := newTestClient(t, server.URL)
+	c.SetRestartCommand("echo run >> "+runs+"; exit 3", 5*time.Second)
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error when the restart command fails")
+	}
+
+	// the port is already set but the restart is still pending
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error when the restart command fails again")
+	}
+	if f.sets != 1 {
+		t.Errorf("Expected a single config change, got %d", f.sets)
+	}
+	data, _ := os.ReadFile(runs)
+	if string(data) != "run\nrun\n" {
+		t.Errorf("Expected the restart command to run twice, got %q", data)
+	}
+
+	// once the restart succeeds it isn't run again
+	c.SetRestartCommand("echo run >> "+runs, 5*time.Second)
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	data, _ = os.ReadFile(runs)
+	if string(data) != "run\nrun\nrun\n" {
+		t.Errorf("Expected the restart command to run three times, got %q", data)
+	}
+}
+
+func TestPushWithoutSwarmPort(t *testing.T) {
+	f := &fakeKubo{config: map[string][]string{
+		"Addresses.Swarm":    {"/ip4/0.0.0.0/p2p-circuit"},
+		"Addresses.Announce": {},
+	}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL)
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error without a tcp or udp multiaddr")
+	}
+}
+
+func TestRewriteMultiaddrs(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/tcp/44201"},
+		{"/ip6/::/udp/4001/quic-v1/webtransport", "/ip6/::/udp/44201/quic-v1/webtransport"},
+		{"/ip4/0.0.0.0/tcp/4001/ws", "/ip4/0.0.0.0/tcp/44201/ws"},
+		{"/dns4/tcp/tcp/4001", "/dns4/tcp/tcp/44201"},
+		{"/ip4/0.0.0.0/p2p-circuit", "/ip4/0.0.0.0/p2p-circuit"},
+		{"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnoo", "/dnsaddr/bootstrap.libp2p.io/p2p/QmNnoo"},
+	}
+	for _, test := range tests {
+		got, _ := rewriteMultiaddrs([]string{test.addr}, 44201)
+		if got[0] != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.addr, test.expected, got[0])
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package lease
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Keeps a port mapping leased. The mapping is renewed half way through every lease, as NAT-PMP, PCP and
+// UPnP IGD recommend. A failed renewal is retried, waiting twice as long after every failure but never more
+// than half of what's left of the lease, so there are several tries before it expires.
+type Renewer struct {
+	renew     func() error // maps again and reports the new lease with Granted
+	retryMin  time.Duration
+	Log       logging.Logger
+	mu        sync.Mutex
+	expires   time.Time // when the current lease ends
+	permanent bool
+	timer     *time.Timer
+	failures  int // renewals failed in a row
+	closed    bool
+}
+
+func NewRenewer(renew func() error, logger logging.Logger) *Renewer {
+	return &Renewer{
+		renew:    renew,
+		retryMin: 5 * time.Second,
+		Log:      logger,
+	}
+}
+
+// Records a lease and schedules its renewal. A lifetime of 0 is a permanent mapping that isn't renewed.
+func (r *Renewer) Granted(lifetime time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = 0
+	r.permanent = lifetime <= 0
+	r.expires = time.Time{}
+	r.stop()
+	if r.permanent || r.closed {
+		return
+	}
+	r.expires = time.Now().Add(lifetime)
+	r.timer = time.AfterFunc(lifetime/2, r.fire)
+}
+
+// Whether a lease was granted and hasn't expired
+func (r *Renewer) Valid() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.permanent || time.Now().Before(r.expires)
+}
+
+// When the current lease ends, zero for permanent mappings
+func (r *Renewer) Expires() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expires
+}
+
+// Stops renewing
+func (r *Renewer) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.stop()
+}
+
+// Must hold r.mu
+func (r *Renewer) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// Runs without r.mu so renew can call Granted
+func (r *Renewer) fire() {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return
+	}
+	err := r.renew()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil || r.closed {
+		return
+	}
+	delay := r.retryDelay()
+	r.Log.Error("renewal error: %v, retrying in %v", err, delay.Round(time.Millisecond))
+	r.stop()
+	r.timer = time.AfterFunc(delay, r.fire)
+}
+
+// How long to wait after a failed renewal. Must hold r.mu.
+func (r *Renewer) retryDelay() time.Duration {
+	delay := r.retryMin << min(r.failures, 8)
+	if left := time.Until(r.expires) / 2; left > r.retryMin && delay > left {
+		delay = left
+	}
+	r.failures++
+	return delay
+}
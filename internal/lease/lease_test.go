@@ -0,0 +1,128 @@
+package lease
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// A mapping that fails the first renewals and grants lifetime once it works
+type fakeMapping struct {
+	mu       sync.Mutex
+	r        *Renewer
+	lifetime time.Duration
+	failing  int
+	renewals int
+}
+
+func newFakeMapping(lifetime time.Duration, failing int) *fakeMapping {
+	m := &fakeMapping{lifetime: lifetime, failing: failing}
+	m.r = NewRenewer(m.renew, logging.NewLogger(logging.ERROR))
+	m.r.retryMin = 10 * time.Millisecond
+	return m
+}
+
+func (m *fakeMapping) renew() error {
+	m.mu.Lock()
+	m.renewals++
+	failing := m.renewals <= m.failing
+	m.mu.Unlock()
+	if failing {
+		return errors.New("network failure")
+	}
+	m.r.Granted(m.lifetime)
+	return nil
+}
+
+func (m *fakeMapping) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.renewals
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRenewHalfWay(t *testing.T) {
+	m := newFakeMapping(400*time.Millisecond, 0)
+	defer m.r.Close()
+
+	start := time.Now()
+	m.r.Granted(400 * time.Millisecond)
+	if !m.r.Valid() {
+		t.Errorf("Expected a valid lease")
+	}
+	waitFor(t, func() bool { return m.count() >= 1 })
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 350*time.Millisecond {
+		t.Errorf("Expected the renewal half way through the lease, got %v", elapsed)
+	}
+	waitFor(t, func() bool { return m.count() >= 2 })
+}
+
+func TestRetriesBeforeExpiry(t *testing.T) {
+	m := newFakeMapping(2*time.Second, 3)
+	defer m.r.Close()
+
+	m.r.Granted(time.Second)
+	waitFor(t, func() bool { return m.count() >= 4 })
+	if !m.r.Valid() || time.Until(m.r.Expires()) < time.Second {
+		t.Errorf("Expected a fresh lease after the retries, expires in %v", time.Until(m.r.Expires()))
+	}
+	m.r.mu.Lock()
+	defer m.r.mu.Unlock()
+	if m.r.failures != 0 {
+		t.Errorf("Expected the failures to reset, got %d", m.r.failures)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	r := NewRenewer(nil, logging.NewLogger(logging.ERROR))
+	r.retryMin = time.Second
+
+	// doubles while the lease has time left
+	r.expires = time.Now().Add(time.Hour)
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if got := r.retryDelay(); got != expected {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+	}
+
+	// never more than half of what's left
+	r.expires = time.Now().Add(10 * time.Second)
+	if got := r.retryDelay(); got > 5*time.Second || got < 4*time.Second {
+		t.Errorf("Expected about 5s, got %v", got)
+	}
+
+	// expired, keeps backing off up to 256 times retryMin
+	r.expires = time.Now().Add(-time.Minute)
+	r.failures = 20
+	if got := r.retryDelay(); got != 256*time.Second {
+		t.Errorf("Expected 256s, got %v", got)
+	}
+}
+
+func TestPermanentAndClose(t *testing.T) {
+	m := newFakeMapping(time.Second, 0)
+	m.r.Granted(0)
+	if !m.r.Valid() || !m.r.Expires().IsZero() {
+		t.Errorf("Expected a permanent lease")
+	}
+
+	m.r.Granted(100 * time.Millisecond)
+	m.r.Close()
+	time.Sleep(150 * time.Millisecond)
+	if m.count() != 0 {
+		t.Errorf("Expected no renewal after Close, got %d", m.count())
+	}
+}
@@ -0,0 +1,243 @@
+package natpmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/lease"
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// NAT-PMP (RFC 6886) opcodes
+const (
+	opMapUDP   = 1
+	opMapTCP   = 2
+	opResponse = 128
+)
+
+// NAT-PMP result codes
+var resultCodes = map[uint16]string{
+	0: "success",
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// Requests a port mapping from a NAT-PMP gateway, e.g. the ProtonVPN WireGuard gateway 10.2.0.1,
+// and keeps renewing it before the lease expires.
+type Client struct {
+	gateway      string
+	port         int
+	internalPort int
+	lifetime     time.Duration
+	timeout      time.Duration
+	tries        int
+	Log          logging.Logger
+	mu           sync.Mutex
+	mapped       int // current external port, 0 when there is no mapping
+	renewer      *lease.Renewer
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("gateway=%s port=%d internal_port=%d lifetime=%v", c.gateway, c.port, c.internalPort, c.lifetime)
+}
+
+func NewClient(gateway string, port int, internalPort int, lifetime time.Duration, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "natpmp: "}
+	c := &Client{
+		gateway:      gateway,
+		port:         port,
+		internalPort: internalPort,
+		lifetime:     lifetime,
+		timeout:      250 * time.Millisecond,
+		tries:        4,
+		Log:          logger,
+	}
+	c.renewer = lease.NewRenewer(c.renew, logger)
+	return c
+}
+
+// Pull the forwarded port from the NAT-PMP gateway.
+// A mapping is only requested when there is no unexpired lease, renewals happen in the background.
+func (c *Client) PullPorts() ([]int, error) {
+	port, err := c.doPullPort()
+	if err != nil {
+		c.Log.Error("pull port error: %v", err)
+		return nil, err
+	}
+	return []int{port}, nil
+}
+
+func (c *Client) doPullPort() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.mapped != 0 && c.renewer.Valid() {
+		c.Log.Info("Forwarded port is %d, lease expires in %v", c.mapped, time.Until(c.renewer.Expires()).Round(time.Second))
+		return c.mapped, nil
+	}
+	if err := c.mapPorts(); err != nil {
+		return -1, err
+	}
+	c.Log.Info("Forwarded port is %d", c.mapped)
+	return c.mapped, nil
+}
+
+// Stops renewing the mapping
+func (c *Client) Close() {
+	c.renewer.Close()
+}
+
+// Requests UDP and TCP mappings and schedules their renewal. Must hold c.mu.
+func (c *Client) mapPorts() error {
+	udp, err := c.request(opMapUDP, c.mapped)
+	if err != nil {
+		return fmt.Errorf("UDP mapping failed: %w", err)
+	}
+	c.Log.Debug("UDP mapping %v", udp)
+
+	// ask for the same external port for TCP
+	tcp, err := c.request(opMapTCP, udp.externalPort)
+	if err != nil {
+		return fmt.Errorf("TCP mapping failed: %w", err)
+	}
+	c.Log.Debug("TCP mapping %v", tcp)
+	if tcp.externalPort != udp.externalPort {
+		c.Log.Warn("Gateway mapped TCP to port %d and UDP to port %d, using %d", tcp.externalPort, udp.externalPort, udp.externalPort)
+	}
+
+	lifetime := udp.lifetime
+	if tcp.lifetime < lifetime {
+		lifetime = tcp.lifetime
+	}
+	if lifetime <= 0 {
+		return fmt.Errorf("gateway granted a lease of %v", lifetime)
+	}
+	if c.mapped != 0 && c.mapped != udp.externalPort {
+		c.Log.Info("Forwarded port changed from %d to %d", c.mapped, udp.externalPort)
+	}
+	c.mapped = udp.externalPort
+
+	// renewed half way through the lease, as RFC 6886 recommends
+	c.renewer.Granted(lifetime)
+	return nil
+}
+
+func (c *Client) renew() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.mapPorts(); err != nil {
+		return err
+	}
+	c.Log.Debug("Renewed port %d until %v", c.mapped, c.renewer.Expires().Format(time.RFC3339))
+	return nil
+}
+
+type mapResponse struct {
+	op           byte
+	epoch        uint32
+	internalPort int
+	externalPort int
+	lifetime     time.Duration
+}
+
+func (r *mapResponse) String() string {
+	return fmt.Sprintf("op=%d epoch=%d internal=%d external=%d lifetime=%v", r.op, r.epoch, r.internalPort, r.externalPort, r.lifetime)
+}
+
+// Builds a mapping request
+//
+//	0      version (0)
+//	1      opcode (1=UDP, 2=TCP)
+//	2-3    reserved
+//	4-5    internal port
+//	6-7    suggested external port
+//	8-11   requested lifetime in seconds
+func encodeMapRequest(op byte, internalPort int, externalPort int, lifetime time.Duration) []byte {
+	b := make([]byte, 12)
+	b[1] = op
+	binary.BigEndian.PutUint16(b[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(b[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(b[8:], uint32(lifetime/time.Second))
+	return b
+}
+
+// Parses a mapping response
+//
+//	0      version (0)
+//	1      opcode + 128
+//	2-3    result code
+//	4-7    seconds since start of epoch
+//	8-9    internal port
+//	10-11  mapped external port
+//	12-15  lifetime in seconds
+func decodeMapResponse(b []byte, op byte) (*mapResponse, error) {
+	if len(b) < 16 {
+		return nil, fmt.Errorf("response too short: %d bytes", len(b))
+	}
+	if b[0] != 0 {
+		return nil, fmt.Errorf("unsupported version %d", b[0])
+	}
+	if b[1] != opResponse+op {
+		return nil, fmt.Errorf("unexpected opcode %d", b[1])
+	}
+	if result := binary.BigEndian.Uint16(b[2:]); result != 0 {
+		return nil, fmt.Errorf("gateway returned result %d (%s)", result, resultCodes[result])
+	}
+	return &mapResponse{
+		op:           op,
+		epoch:        binary.BigEndian.Uint32(b[4:]),
+		internalPort: int(binary.BigEndian.Uint16(b[8:])),
+		externalPort: int(binary.BigEndian.Uint16(b[10:])),
+		lifetime:     time.Duration(binary.BigEndian.Uint32(b[12:])) * time.Second,
+	}, nil
+}
+
+// Sends a mapping request, retrying with a doubling timeout like RFC 6886 section 3.1
+func (c *Client) request(op byte, externalPort int) (*mapResponse, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(c.gateway, strconv.Itoa(c.port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := encodeMapRequest(op, c.internalPort, externalPort, c.lifetime)
+	buf := make([]byte, 16)
+	timeout := c.timeout
+	for try := 1; ; try++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && try < c.tries {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+		if unmatched(buf[:n], op, c.internalPort) {
+			// an answer to an earlier request, counted as a try so a stream of them can't keep us here
+			c.Log.Debug("ignoring response for another request % x", buf[:n])
+			if try < c.tries {
+				continue
+			}
+			return nil, fmt.Errorf("no response for this mapping after %d tries", c.tries)
+		}
+		return decodeMapResponse(buf[:n], op)
+	}
+}
+
+// Whether a response answers another request, with another opcode or internal port.
+// Malformed responses are left to decodeMapResponse.
+func unmatched(b []byte, op byte, internalPort int) bool {
+	return len(b) >= 16 && (b[1] != opResponse+op || int(binary.BigEndian.Uint16(b[8:])) != internalPort)
+}
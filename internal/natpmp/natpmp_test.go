@@ -0,0 +1,224 @@
+package natpmp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// In-process NAT-PMP responder that always maps to the same external port
+type fakeGateway struct {
+	conn     *net.UDPConn
+	external int
+	result   uint16
+	stray    bool // answer every request for another internal port first
+	mu       sync.Mutex
+	requests []mapRequest
+}
+
+type mapRequest struct {
+	op       byte
+	internal int
+	external int
+	lifetime uint32
+}
+
+func newFakeGateway(t *testing.T, external int) *fakeGateway {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeGateway{conn: conn, external: external}
+	t.Cleanup(func() { conn.Close() })
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		req := mapRequest{
+			op:       buf[1],
+			internal: int(binary.BigEndian.Uint16(buf[4:])),
+			external: int(binary.BigEndian.Uint16(buf[6:])),
+			lifetime: binary.BigEndian.Uint32(buf[8:]),
+		}
+		g.mu.Lock()
+		g.requests = append(g.requests, req)
+		external := g.external
+		result := g.result
+		stray := g.stray
+		g.mu.Unlock()
+
+		res := make([]byte, 16)
+		res[1] = req.op + opResponse
+		binary.BigEndian.PutUint16(res[2:], result)
+		binary.BigEndian.PutUint32(res[4:], 1000)
+		binary.BigEndian.PutUint16(res[8:], uint16(req.internal))
+		binary.BigEndian.PutUint16(res[10:], uint16(external))
+		binary.BigEndian.PutUint32(res[12:], req.lifetime)
+		if stray {
+			other := append([]byte{}, res...)
+			binary.BigEndian.PutUint16(other[8:], uint16(req.internal+1))
+			g.conn.WriteToUDP(other, addr)
+		}
+		g.conn.WriteToUDP(res, addr)
+	}
+}
+
+func (g *fakeGateway) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.requests)
+}
+
+func newTestClient(g *fakeGateway, lifetime time.Duration) *Client {
+	addr := g.conn.LocalAddr().(*net.UDPAddr)
+	return NewClient("127.0.0.1", addr.Port, 1, lifetime, logging.NewLogger(logging.ERROR))
+}
+
+func TestEncodeDecode(t *testing.T) {
+	req := encodeMapRequest(opMapTCP, 1, 45678, 60*time.Second)
+	expected := []byte{0, 2, 0, 0, 0, 1, 0xb2, 0x6e, 0, 0, 0, 60}
+	if string(req) != string(expected) {
+		t.Errorf("Expected %v, got %v", expected, req)
+	}
+
+	res := []byte{0, 130, 0, 0, 0, 0, 3, 232, 0, 1, 0xb2, 0x6e, 0, 0, 0, 60}
+	r, err := decodeMapResponse(res, opMapTCP)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if r.externalPort != 45678 || r.internalPort != 1 || r.lifetime != 60*time.Second || r.epoch != 1000 {
+		t.Errorf("Unexpected response %v", r)
+	}
+
+	if _, err := decodeMapResponse(res, opMapUDP); err == nil {
+		t.Errorf("Expected error for mismatched opcode")
+	}
+	res[3] = 2
+	if _, err := decodeMapResponse(res, opMapTCP); err == nil {
+		t.Errorf("Expected error for result code 2")
+	}
+	if _, err := decodeMapResponse(res[:8], opMapTCP); err == nil {
+		t.Errorf("Expected error for a short response")
+	}
+}
+
+func TestPullPorts(t *testing.T) {
+	g := newFakeGateway(t, 45678)
+	c := newTestClient(g, 60*time.Second)
+	defer c.Close()
+
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 45678 {
+		t.Errorf("Expected port 45678, got %v", ports)
+	}
+	g.mu.Lock()
+	if len(g.requests) != 2 || g.requests[0].op != opMapUDP || g.requests[1].op != opMapTCP {
+		t.Errorf("Expected a UDP then a TCP mapping request, got %v", g.requests)
+	}
+	if g.requests[1].external != 45678 || g.requests[1].internal != 1 || g.requests[1].lifetime != 60 {
+		t.Errorf("Unexpected TCP mapping request %v", g.requests[1])
+	}
+	g.mu.Unlock()
+
+	// the lease is still valid, nothing is requested
+	if _, err := c.PullPorts(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if g.count() != 2 {
+		t.Errorf("Expected no new requests while the lease is valid, got %d requests", g.count())
+	}
+}
+
+func TestStrayResponses(t *testing.T) {
+	g := newFakeGateway(t, 45678)
+	g.stray = true
+	c := newTestClient(g, 60*time.Second)
+	defer c.Close()
+
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 45678 {
+		t.Errorf("Expected port 45678, got %v", ports)
+	}
+
+	if !unmatched([]byte{0, 130, 0, 0, 0, 0, 3, 232, 0, 1, 0xb2, 0x6e, 0, 0, 0, 60}, opMapUDP, 1) {
+		t.Errorf("Expected a TCP response to be unmatched for a UDP request")
+	}
+	if unmatched([]byte{0, 130, 0, 0}, opMapUDP, 1) {
+		t.Errorf("Expected a short response to be left to the decoder")
+	}
+}
+
+func TestRenewal(t *testing.T) {
+	g := newFakeGateway(t, 45678)
+	c := newTestClient(g, time.Second)
+	defer c.Close()
+
+	if _, err := c.PullPorts(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	g.mu.Lock()
+	g.external = 45679
+	g.mu.Unlock()
+
+	// renewal happens half way through the 1s lease
+	deadline := time.Now().Add(3 * time.Second)
+	for g.count() < 4 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if g.count() < 4 {
+		t.Fatalf("Expected the mapping to be renewed, got %d requests", g.count())
+	}
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if ports[0] != 45679 {
+		t.Errorf("Expected renewed port 45679, got %v", ports)
+	}
+}
+
+func TestPullPortsRefused(t *testing.T) {
+	g := newFakeGateway(t, 45678)
+	g.mu.Lock()
+	g.result = 2
+	g.mu.Unlock()
+	c := newTestClient(g, 60*time.Second)
+	defer c.Close()
+
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error when the gateway refuses the mapping")
+	}
+}
+
+func TestPullPortsTimeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewClient("127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port, 1, 60*time.Second, logging.NewLogger(logging.ERROR))
+	c.timeout = 10 * time.Millisecond
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error when the gateway doesn't answer")
+	}
+}
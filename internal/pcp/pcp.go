@@ -0,0 +1,384 @@
+package pcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/lease"
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/source"
+)
+
+// PCP (RFC 6887) constants
+const (
+	version    = 2
+	opMap      = 1
+	opResponse = 128
+	protoTCP   = 6
+	protoUDP   = 17
+	headerSize = 24
+	mapSize    = 36
+)
+
+// A PCP result code, RFC 6887 section 7.4
+type ResultCode uint8
+
+const (
+	Success               ResultCode = 0
+	UnsuppVersion         ResultCode = 1
+	NotAuthorized         ResultCode = 2
+	MalformedRequest      ResultCode = 3
+	UnsuppOpcode          ResultCode = 4
+	UnsuppOption          ResultCode = 5
+	MalformedOption       ResultCode = 6
+	NetworkFailure        ResultCode = 7
+	NoResources           ResultCode = 8
+	UnsuppProtocol        ResultCode = 9
+	UserExQuota           ResultCode = 10
+	CannotProvideExternal ResultCode = 11
+	AddressMismatch       ResultCode = 12
+	ExcessiveRemotePeers  ResultCode = 13
+)
+
+var resultCodeNames = [...]string{
+	"SUCCESS",
+	"UNSUPP_VERSION",
+	"NOT_AUTHORIZED",
+	"MALFORMED_REQUEST",
+	"UNSUPP_OPCODE",
+	"UNSUPP_OPTION",
+	"MALFORMED_OPTION",
+	"NETWORK_FAILURE",
+	"NO_RESOURCES",
+	"UNSUPP_PROTOCOL",
+	"USER_EX_QUOTA",
+	"CANNOT_PROVIDE_EXTERNAL",
+	"ADDRESS_MISMATCH",
+	"EXCESSIVE_REMOTE_PEERS",
+}
+
+// Stringer
+func (r ResultCode) String() string {
+	if int(r) >= len(resultCodeNames) {
+		return "UNKNOWN"
+	}
+	return resultCodeNames[r]
+}
+
+// Returned when the server answers with a result other than SUCCESS
+type ResultError struct {
+	Code ResultCode
+	// How long the server says the error will last
+	Lifetime time.Duration
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("server returned result %d (%s)", uint8(e.Code), e.Code)
+}
+
+// Short lifetime errors (RFC 6887 section 7.4) may go away by themselves, the rest need a configuration change
+func (e *ResultError) Temporary() bool {
+	switch e.Code {
+	case NetworkFailure, NoResources, UserExQuota, ExcessiveRemotePeers:
+		return true
+	default:
+		return false
+	}
+}
+
+// Requests a port mapping from a PCP server, e.g. a CGNAT or VPN gateway, and keeps renewing it before the lease expires.
+type Client struct {
+	server       string
+	port         int
+	internalPort int
+	externalPort int // suggested external port, 0 lets the server pick
+	lifetime     time.Duration
+	timeout      time.Duration
+	tries        int
+	Log          logging.Logger
+	mu           sync.Mutex
+	nonce        [12]byte
+	mapped       int    // current external port, 0 when there is no mapping
+	external     net.IP // current external address
+	renewer      *lease.Renewer
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("server=%s port=%d internal_port=%d external_port=%d lifetime=%v", c.server, c.port, c.internalPort, c.externalPort, c.lifetime)
+}
+
+func NewClient(server string, port int, internalPort int, lifetime time.Duration, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "pcp: "}
+	c := &Client{
+		server:       server,
+		port:         port,
+		internalPort: internalPort,
+		lifetime:     lifetime,
+		timeout:      250 * time.Millisecond,
+		tries:        4,
+		Log:          logger,
+	}
+	c.renewer = lease.NewRenewer(c.renew, logger)
+	// the same nonce renews the same mapping
+	rand.Read(c.nonce[:])
+	return c
+}
+
+// External port to suggest to the server
+func (c *Client) SetExternalPort(port int) {
+	c.externalPort = port
+}
+
+// Pull the forwarded port from the PCP server.
+// A mapping is only requested when there is no unexpired lease, renewals happen in the background.
+func (c *Client) PullPorts() ([]int, error) {
+	port, err := c.doPullPort()
+	if err != nil {
+		c.Log.Error("pull port error: %v", err)
+		return nil, err
+	}
+	return []int{port}, nil
+}
+
+func (c *Client) doPullPort() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.mapped != 0 && c.renewer.Valid() {
+		c.Log.Info("Forwarded port is %d on %s, lease expires in %v", c.mapped, c.external, time.Until(c.renewer.Expires()).Round(time.Second))
+		return c.mapped, nil
+	}
+	if err := c.mapPorts(); err != nil {
+		return -1, err
+	}
+	c.Log.Info("Forwarded port is %d on %s", c.mapped, c.external)
+	return c.mapped, nil
+}
+
+// The external address of the mapping, requesting one when there is no unexpired lease
+func (c *Client) PullPublicIP() (*source.PublicIP, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.mapped == 0 || !c.renewer.Valid() {
+		if err := c.mapPorts(); err != nil {
+			c.Log.Error("pull public IP error: %v", err)
+			return nil, err
+		}
+	}
+	c.Log.Info("Public IP is %s", c.external)
+	return &source.PublicIP{IP: c.external.String()}, nil
+}
+
+// Stops renewing the mapping
+func (c *Client) Close() {
+	c.renewer.Close()
+}
+
+// Requests UDP and TCP mappings and schedules their renewal. Must hold c.mu.
+func (c *Client) mapPorts() error {
+	suggested := c.mapped
+	if suggested == 0 {
+		suggested = c.externalPort
+	}
+	udp, err := c.request(protoUDP, suggested)
+	if err != nil {
+		return fmt.Errorf("UDP mapping failed: %w", err)
+	}
+	c.Log.Debug("UDP mapping %v", udp)
+
+	// ask for the same external port for TCP
+	tcp, err := c.request(protoTCP, udp.externalPort)
+	if err != nil {
+		return fmt.Errorf("TCP mapping failed: %w", err)
+	}
+	c.Log.Debug("TCP mapping %v", tcp)
+	if tcp.externalPort != udp.externalPort {
+		c.Log.Warn("Server mapped TCP to port %d and UDP to port %d, using %d", tcp.externalPort, udp.externalPort, udp.externalPort)
+	}
+
+	lifetime := udp.lifetime
+	if tcp.lifetime < lifetime {
+		lifetime = tcp.lifetime
+	}
+	if lifetime <= 0 {
+		return fmt.Errorf("server granted a lease of %v", lifetime)
+	}
+	if c.mapped != 0 && c.mapped != udp.externalPort {
+		c.Log.Info("Forwarded port changed from %d to %d", c.mapped, udp.externalPort)
+	}
+	c.mapped = udp.externalPort
+	c.external = udp.externalIP
+
+	// renewed half way through the lease, as RFC 6887 section 11.2.1 allows
+	c.renewer.Granted(lifetime)
+	return nil
+}
+
+func (c *Client) renew() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.mapPorts(); err != nil {
+		return err
+	}
+	c.Log.Debug("Renewed port %d until %v", c.mapped, c.renewer.Expires().Format(time.RFC3339))
+	return nil
+}
+
+type mapRequest struct {
+	lifetime     time.Duration
+	clientIP     net.IP
+	nonce        [12]byte
+	protocol     byte
+	internalPort int
+	externalPort int
+	externalIP   net.IP
+}
+
+type mapResponse struct {
+	result       ResultCode
+	lifetime     time.Duration
+	epoch        uint32
+	nonce        [12]byte
+	protocol     byte
+	internalPort int
+	externalPort int
+	externalIP   net.IP
+}
+
+func (r *mapResponse) String() string {
+	return fmt.Sprintf("protocol=%d epoch=%d internal=%d external=%s lifetime=%v", r.protocol, r.epoch, r.internalPort, net.JoinHostPort(r.externalIP.String(), strconv.Itoa(r.externalPort)), r.lifetime)
+}
+
+// Builds a MAP request, a common header followed by the MAP opcode payload
+//
+//	0      version (2)
+//	1      R bit (0) and opcode (1=MAP)
+//	2-3    reserved
+//	4-7    requested lifetime in seconds
+//	8-23   client IP address, IPv4 as ::ffff:a.b.c.d
+//	24-35  mapping nonce
+//	36     protocol (6=TCP, 17=UDP)
+//	37-39  reserved
+//	40-41  internal port
+//	42-43  suggested external port
+//	44-59  suggested external IP address
+func encodeMapRequest(r *mapRequest) []byte {
+	b := make([]byte, headerSize+mapSize)
+	b[0] = version
+	b[1] = opMap
+	binary.BigEndian.PutUint32(b[4:], uint32(r.lifetime/time.Second))
+	copy(b[8:24], r.clientIP.To16())
+	copy(b[24:36], r.nonce[:])
+	b[36] = r.protocol
+	binary.BigEndian.PutUint16(b[40:], uint16(r.internalPort))
+	binary.BigEndian.PutUint16(b[42:], uint16(r.externalPort))
+	copy(b[44:60], r.externalIP.To16())
+	return b
+}
+
+// Parses a MAP response
+//
+//	0      version (2)
+//	1      R bit (1) and opcode
+//	2      reserved
+//	3      result code
+//	4-7    lifetime in seconds, how long the mapping or the error lasts
+//	8-11   epoch time
+//	12-23  reserved
+//	24-35  mapping nonce
+//	36     protocol
+//	37-39  reserved
+//	40-41  internal port
+//	42-43  assigned external port
+//	44-59  assigned external IP address
+func decodeMapResponse(b []byte) (*mapResponse, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("response too short: %d bytes", len(b))
+	}
+	if b[0] != version {
+		return nil, fmt.Errorf("unsupported version %d", b[0])
+	}
+	if b[1] != opResponse|opMap {
+		return nil, fmt.Errorf("unexpected opcode %d", b[1])
+	}
+	r := &mapResponse{
+		result:   ResultCode(b[3]),
+		lifetime: time.Duration(binary.BigEndian.Uint32(b[4:])) * time.Second,
+		epoch:    binary.BigEndian.Uint32(b[8:]),
+	}
+	if r.result != Success {
+		return nil, &ResultError{Code: r.result, Lifetime: r.lifetime}
+	}
+	if len(b) < headerSize+mapSize {
+		return nil, fmt.Errorf("response too short: %d bytes", len(b))
+	}
+	copy(r.nonce[:], b[24:36])
+	r.protocol = b[36]
+	r.internalPort = int(binary.BigEndian.Uint16(b[40:]))
+	r.externalPort = int(binary.BigEndian.Uint16(b[42:]))
+	r.externalIP = net.IP(append([]byte(nil), b[44:60]...))
+	if ip4 := r.externalIP.To4(); ip4 != nil {
+		r.externalIP = ip4
+	}
+	return r, nil
+}
+
+// Sends a MAP request, retrying with a doubling timeout like RFC 6887 section 8.1.1
+func (c *Client) request(protocol byte, externalPort int) (*mapResponse, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(c.server, strconv.Itoa(c.port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	clientIP := conn.LocalAddr().(*net.UDPAddr).IP
+	externalIP := net.IPv6zero
+	if clientIP.To4() != nil {
+		externalIP = net.IPv4zero
+	}
+	req := encodeMapRequest(&mapRequest{
+		lifetime:     c.lifetime,
+		clientIP:     clientIP,
+		nonce:        c.nonce,
+		protocol:     protocol,
+		internalPort: c.internalPort,
+		externalPort: externalPort,
+		externalIP:   externalIP,
+	})
+	buf := make([]byte, 1100) // the largest PCP message
+	timeout := c.timeout
+	for try := 1; ; try++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && try < c.tries {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+		res, err := decodeMapResponse(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if res.nonce != c.nonce || res.protocol != protocol {
+			// an answer to an earlier request, counted as a try so a stream of them can't keep us here
+			c.Log.Debug("ignoring response for another mapping %v", res)
+			if try < c.tries {
+				continue
+			}
+			return nil, fmt.Errorf("no response for this mapping after %d tries", c.tries)
+		}
+		return res, nil
+	}
+}
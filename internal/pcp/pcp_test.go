@@ -0,0 +1,262 @@
+package pcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// In-process PCP server that always maps to the same external address and port
+type fakeServer struct {
+	conn     *net.UDPConn
+	external int
+	ip       net.IP
+	result   ResultCode
+	nonce    *[12]byte // answers with this nonce instead of the request's
+	mu       sync.Mutex
+	requests []*mapRequest
+}
+
+func newFakeServer(t *testing.T, external int) *fakeServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{conn: conn, external: external, ip: net.IPv4(203, 0, 113, 7)}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < headerSize+mapSize || buf[0] != version || buf[1] != opMap {
+			continue
+		}
+		req := &mapRequest{
+			lifetime:     time.Duration(binary.BigEndian.Uint32(buf[4:])) * time.Second,
+			clientIP:     net.IP(append([]byte(nil), buf[8:24]...)),
+			protocol:     buf[36],
+			internalPort: int(binary.BigEndian.Uint16(buf[40:])),
+			externalPort: int(binary.BigEndian.Uint16(buf[42:])),
+			externalIP:   net.IP(append([]byte(nil), buf[44:60]...)),
+		}
+		copy(req.nonce[:], buf[24:36])
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		res := make([]byte, headerSize+mapSize)
+		res[0] = version
+		res[1] = opResponse | opMap
+		res[3] = byte(s.result)
+		binary.BigEndian.PutUint32(res[4:], uint32(req.lifetime/time.Second))
+		binary.BigEndian.PutUint32(res[8:], 1000)
+		copy(res[24:36], req.nonce[:])
+		if s.nonce != nil {
+			copy(res[24:36], s.nonce[:])
+		}
+		res[36] = req.protocol
+		binary.BigEndian.PutUint16(res[40:], uint16(req.internalPort))
+		binary.BigEndian.PutUint16(res[42:], uint16(s.external))
+		copy(res[44:60], s.ip.To16())
+		s.mu.Unlock()
+		s.conn.WriteToUDP(res, addr)
+	}
+}
+
+func (s *fakeServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func newTestClient(s *fakeServer, lifetime time.Duration) *Client {
+	addr := s.conn.LocalAddr().(*net.UDPAddr)
+	return NewClient("127.0.0.1", addr.Port, 1, lifetime, logging.NewLogger(logging.ERROR))
+}
+
+func TestEncodeDecode(t *testing.T) {
+	req := &mapRequest{
+		lifetime:     120 * time.Second,
+		clientIP:     net.IPv4(10, 2, 0, 2),
+		nonce:        [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		protocol:     protoTCP,
+		internalPort: 1,
+		externalPort: 45678,
+		externalIP:   net.IPv4zero,
+	}
+	b := encodeMapRequest(req)
+	expected := []byte{
+		2, 1, 0, 0, 0, 0, 0, 120,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 2, 0, 2,
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12,
+		6, 0, 0, 0, 0, 1, 0xb2, 0x6e,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 0, 0,
+	}
+	if string(b) != string(expected) {
+		t.Errorf("Expected %v, got %v", expected, b)
+	}
+
+	// turn the request into a response
+	res := append([]byte(nil), b...)
+	res[1] = opResponse | opMap
+	binary.BigEndian.PutUint32(res[8:], 1000)
+	copy(res[12:24], make([]byte, 12))
+	copy(res[44:60], net.IPv4(203, 0, 113, 7).To16())
+	r, err := decodeMapResponse(res)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if r.externalPort != 45678 || r.internalPort != 1 || r.lifetime != 120*time.Second || r.epoch != 1000 || r.protocol != protoTCP {
+		t.Errorf("Unexpected response %v", r)
+	}
+	if !r.externalIP.Equal(net.IPv4(203, 0, 113, 7)) || r.nonce != req.nonce {
+		t.Errorf("Unexpected response %v nonce=%v", r, r.nonce)
+	}
+
+	res[3] = byte(NoResources)
+	_, err = decodeMapResponse(res)
+	var re *ResultError
+	if !errors.As(err, &re) || re.Code != NoResources || re.Lifetime != 120*time.Second || !re.Temporary() {
+		t.Errorf("Expected a temporary NO_RESOURCES error, got %v", err)
+	}
+	res[3] = byte(NotAuthorized)
+	if _, err = decodeMapResponse(res); !errors.As(err, &re) || re.Temporary() {
+		t.Errorf("Expected a permanent NOT_AUTHORIZED error, got %v", err)
+	}
+
+	if _, err := decodeMapResponse(res[:20]); err == nil {
+		t.Errorf("Expected error for a short response")
+	}
+	res[0] = 0
+	if _, err := decodeMapResponse(res); err == nil {
+		t.Errorf("Expected error for a NAT-PMP response")
+	}
+}
+
+func TestResultCodeString(t *testing.T) {
+	if CannotProvideExternal.String() != "CANNOT_PROVIDE_EXTERNAL" {
+		t.Errorf("Unexpected name %s", CannotProvideExternal)
+	}
+	if ResultCode(99).String() != "UNKNOWN" {
+		t.Errorf("Unexpected name %s", ResultCode(99))
+	}
+}
+
+func TestPullPorts(t *testing.T) {
+	s := newFakeServer(t, 45678)
+	c := newTestClient(s, 120*time.Second)
+	c.SetExternalPort(45000)
+	defer c.Close()
+
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 45678 {
+		t.Errorf("Expected port 45678, got %v", ports)
+	}
+	s.mu.Lock()
+	if len(s.requests) != 2 || s.requests[0].protocol != protoUDP || s.requests[1].protocol != protoTCP {
+		t.Errorf("Expected a UDP then a TCP mapping request, got %v", s.requests)
+	}
+	if s.requests[0].externalPort != 45000 || s.requests[1].externalPort != 45678 || s.requests[1].internalPort != 1 {
+		t.Errorf("Unexpected suggested ports %d and %d", s.requests[0].externalPort, s.requests[1].externalPort)
+	}
+	if !s.requests[0].clientIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected client IP 127.0.0.1, got %v", s.requests[0].clientIP)
+	}
+	s.mu.Unlock()
+
+	ip, err := c.PullPublicIP()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if ip.IP != "203.0.113.7" {
+		t.Errorf("Expected external IP 203.0.113.7, got %s", ip.IP)
+	}
+
+	// the lease is still valid, nothing is requested
+	if _, err := c.PullPorts(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if s.count() != 2 {
+		t.Errorf("Expected no new requests while the lease is valid, got %d requests", s.count())
+	}
+}
+
+func TestRenewalKeepsNonce(t *testing.T) {
+	s := newFakeServer(t, 45678)
+	c := newTestClient(s, time.Second)
+	defer c.Close()
+
+	if _, err := c.PullPorts(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for s.count() < 4 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) < 4 {
+		t.Fatalf("Expected the mapping to be renewed, got %d requests", len(s.requests))
+	}
+	if s.requests[2].nonce != s.requests[0].nonce || s.requests[2].externalPort != 45678 {
+		t.Errorf("Expected the renewal to reuse the nonce and port")
+	}
+}
+
+func TestPullPortsResultError(t *testing.T) {
+	s := newFakeServer(t, 45678)
+	s.mu.Lock()
+	s.result = NotAuthorized
+	s.mu.Unlock()
+	c := newTestClient(s, 120*time.Second)
+	defer c.Close()
+
+	_, err := c.PullPorts()
+	var re *ResultError
+	if !errors.As(err, &re) || re.Code != NotAuthorized {
+		t.Errorf("Expected a NOT_AUTHORIZED error, got %v", err)
+	}
+}
+
+func TestPullPortsTimeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewClient("127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port, 1, 120*time.Second, logging.NewLogger(logging.ERROR))
+	c.timeout = 10 * time.Millisecond
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error when the server doesn't answer")
+	}
+}
+
+func TestPullPortsOtherMapping(t *testing.T) {
+	s := newFakeServer(t, 45678)
+	s.mu.Lock()
+	s.nonce = &[12]byte{1, 2, 3}
+	s.mu.Unlock()
+	c := newTestClient(s, 120*time.Second)
+	defer c.Close()
+
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error when every response is for another mapping")
+	}
+	if s.count() != c.tries {
+		t.Errorf("Expected %d requests, got %d", c.tries, s.count())
+	}
+}
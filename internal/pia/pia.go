@@ -0,0 +1,343 @@
+package pia
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+const (
+	// PIA's port forwarding API listens on the WireGuard/OpenVPN gateway
+	apiPort = 19999
+	// where PIA account credentials are exchanged for a token
+	defaultTokenURL = "https://www.privateinternetaccess.com/api/client/v2/token"
+	// PIA drops the port unless bindPort is called at least every 20 minutes
+	defaultKeepAlive = 15 * time.Minute
+	// get a new signature this long before the payload expires
+	defaultRefreshBefore = 24 * time.Hour
+)
+
+// Returned (wrapped) when the gateway answers bindPort with a status other than OK
+var ErrBindRejected = errors.New("bindPort rejected")
+
+// Runs PIA's port forwarding flow: getSignature once, then bindPort keep-alives until the payload expires.
+// Works with the gateway of a tunnel set up by PIA's manual-connections scripts.
+type Client struct {
+	hostname      string
+	token         string
+	user          string
+	pass          string
+	client        *http.Client // talks to the gateway
+	tokenClient   *http.Client // talks to PIA's public API
+	baseURL       string
+	tokenURL      string
+	keepAlive     time.Duration
+	refreshBefore time.Duration
+	Log           logging.Logger
+	mu            sync.Mutex
+	sig           *signature
+	bound         bool // the last bindPort succeeded
+	keepAliveTask *time.Timer
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("hostname=%s url=%s", c.hostname, c.baseURL)
+}
+
+// getSignature response, payload is base64 encoded JSON
+type signatureResp struct {
+	Status    string `json:"status"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+	Message   string `json:"message"`
+}
+
+type payload struct {
+	Token     string    `json:"token"`
+	Port      int       `json:"port"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type signature struct {
+	payload   string
+	signature string
+	port      int
+	expiresAt time.Time
+}
+
+type bindResp struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type tokenResp struct {
+	Token string `json:"token"`
+}
+
+// Builds an HTTP client that reaches the port forwarding API at https://<hostname>:19999 through the gateway IP
+// and verifies it with PIA's CA certificate (ca.rsa.4096.crt from the manual-connections scripts).
+func NewHTTPClient(gateway string, hostname string, caPEM []byte) (*http.Client, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in CA file")
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	target := net.JoinHostPort(hostname, fmt.Sprint(apiPort))
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    pool,
+			ServerName: hostname,
+		},
+		// like curl --connect-to, the hostname isn't in DNS
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == target {
+				addr = net.JoinHostPort(gateway, fmt.Sprint(apiPort))
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+func NewClient(hostname string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "pia: "}
+	return &Client{
+		hostname:      hostname,
+		client:        httpClient,
+		tokenClient:   http.DefaultClient,
+		baseURL:       fmt.Sprintf("https://%s:%d", hostname, apiPort),
+		tokenURL:      defaultTokenURL,
+		keepAlive:     defaultKeepAlive,
+		refreshBefore: defaultRefreshBefore,
+		Log:           logger,
+	}
+}
+
+// Uses a token that was already generated, e.g. by PIA's get_token.sh
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// Generates a fresh token from PIA account credentials whenever a new signature is needed
+func (c *Client) SetLogin(user string, pass string) {
+	c.user = user
+	c.pass = pass
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	return req, nil
+}
+
+// Pull the forwarded port from PIA.
+// A signature is requested the first time and again shortly before it expires. The port is bound right away
+// and kept alive in the background.
+func (c *Client) PullPorts() ([]int, error) {
+	port, err := c.doPullPort()
+	if err != nil {
+		c.Log.Error("pull port error: %v", err)
+		return nil, err
+	}
+	return []int{port}, nil
+}
+
+func (c *Client) doPullPort() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sig == nil || time.Until(c.sig.expiresAt) < c.refreshBefore {
+		if err := c.refreshSignature(); err != nil {
+			return -1, err
+		}
+		c.bound = false
+	}
+
+	if !c.bound {
+		if err := c.bindPort(); err != nil {
+			// a rejected payload won't get better, start over on the next pull.
+			// Other errors only retry bindPort, a new signature would usually mean a new port.
+			if errors.Is(err, ErrBindRejected) {
+				c.sig = nil
+			}
+			return -1, err
+		}
+		c.scheduleKeepAlive()
+	}
+
+	c.Log.Info("Forwarded port is %d, signature expires %s", c.sig.port, c.sig.expiresAt.Format(time.RFC3339))
+	return c.sig.port, nil
+}
+
+// Stops the bindPort keep-alives
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keepAliveTask != nil {
+		c.keepAliveTask.Stop()
+		c.keepAliveTask = nil
+	}
+}
+
+// Must hold c.mu
+func (c *Client) scheduleKeepAlive() {
+	if c.keepAliveTask != nil {
+		c.keepAliveTask.Stop()
+	}
+	c.keepAliveTask = time.AfterFunc(c.keepAlive, c.runKeepAlive)
+}
+
+func (c *Client) runKeepAlive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keepAliveTask == nil || c.sig == nil {
+		// closed
+		return
+	}
+	if err := c.bindPort(); err != nil {
+		c.Log.Error("keep-alive error: %v", err)
+		c.bound = false
+		return
+	}
+	c.Log.Debug("keep-alive OK for port %d", c.sig.port)
+	c.scheduleKeepAlive()
+}
+
+// Must hold c.mu
+func (c *Client) refreshSignature() error {
+	token := c.token
+	if c.user != "" {
+		t, err := c.getToken()
+		if err != nil {
+			return err
+		}
+		token = t
+	}
+	if token == "" {
+		return fmt.Errorf("no PIA token available")
+	}
+
+	uri := fmt.Sprintf("%s/getSignature?token=%s", c.baseURL, url.QueryEscape(token))
+	var sigResp *signatureResp
+	if err := c.getJSON(uri, &sigResp); err != nil {
+		return fmt.Errorf("getSignature failed: %w", err)
+	}
+	if sigResp.Status != "OK" {
+		return fmt.Errorf("getSignature failed with status %s: %s", sigResp.Status, sigResp.Message)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sigResp.Payload)
+	if err != nil {
+		return fmt.Errorf("could not decode payload: %s", err)
+	}
+	var p *payload
+	if err = json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("could not unmarshal payload: %s", err)
+	}
+	if p.Port <= 0 || p.Port > 65535 {
+		return fmt.Errorf("payload has invalid port %d", p.Port)
+	}
+
+	c.sig = &signature{
+		payload:   sigResp.Payload,
+		signature: sigResp.Signature,
+		port:      p.Port,
+		expiresAt: p.ExpiresAt,
+	}
+	c.Log.Info("Got signature for port %d, expires %s", p.Port, p.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// Must hold c.mu
+func (c *Client) bindPort() error {
+	data := url.Values{}
+	data.Set("payload", c.sig.payload)
+	data.Set("signature", c.sig.signature)
+	uri := fmt.Sprintf("%s/bindPort?%s", c.baseURL, data.Encode())
+
+	var res *bindResp
+	if err := c.getJSON(uri, &res); err != nil {
+		return fmt.Errorf("bindPort failed: %w", err)
+	}
+	if res.Status != "OK" {
+		return fmt.Errorf("%w with status %s: %s", ErrBindRejected, res.Status, res.Message)
+	}
+	c.bound = true
+	c.Log.Debug("bindPort OK: %s", res.Message)
+	return nil
+}
+
+func (c *Client) getToken() (string, error) {
+	data := url.Values{}
+	data.Set("username", c.user)
+	data.Set("password", c.pass)
+	req, err := c.newRequest(http.MethodPost, c.tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.tokenClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed, got HTTP %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response %s", err)
+	}
+	var t *tokenResp
+	if err = json.Unmarshal(body, &t); err != nil {
+		return "", fmt.Errorf("could not unmarshal json: %s", err)
+	}
+	if t.Token == "" {
+		return "", fmt.Errorf("token request returned no token")
+	}
+	return t.Token, nil
+}
+
+// GETs from the gateway's port forwarding API
+func (c *Client) getJSON(uri string, v any) error {
+	req, err := c.newRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response %s", err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("could not unmarshal json: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package pia
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Local stand-in for PIA's token API and the gateway's port forwarding API
+type fakePIA struct {
+	mu         sync.Mutex
+	port       int
+	expiresIn  time.Duration
+	signatures int
+	binds      int
+	tokens     int
+	bindStatus string
+	bindFails  int // bindPort requests answered with HTTP 502
+}
+
+func (f *fakePIA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/token":
+		r.ParseForm()
+		if r.PostForm.Get("username") != "p1234567" || r.PostForm.Get("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.tokens++
+		fmt.Fprint(w, `{"token":"fresh-token"}`)
+	case "/getSignature":
+		token := r.URL.Query().Get("token")
+		if token != "fresh-token" && token != "static-token" {
+			fmt.Fprint(w, `{"status":"ERROR","message":"invalid token"}`)
+			return
+		}
+		f.signatures++
+		p, _ := json.Marshal(payload{Token: token, Port: f.port, ExpiresAt: time.Now().Add(f.expiresIn)})
+		fmt.Fprintf(w, `{"status":"OK","payload":"%s","signature":"sig%d"}`, base64.StdEncoding.EncodeToString(p), f.signatures)
+	case "/bindPort":
+		if r.URL.Query().Get("signature") == "" || r.URL.Query().Get("payload") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.binds++
+		if f.bindFails > 0 {
+			f.bindFails--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"%s","message":"port scheduled for add"}`, f.bindStatus)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakePIA) counts() (int, int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tokens, f.signatures, f.binds
+}
+
+func newTestClient(t *testing.T, fake *fakePIA) *Client {
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	c := NewClient("nl-amsterdam.privacy.network", srv.Client(), logging.NewLogger(logging.ERROR))
+	c.baseURL = srv.URL
+	c.tokenURL = srv.URL + "/token"
+	c.tokenClient = srv.Client()
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestPullPorts(t *testing.T) {
+	fake := &fakePIA{port: 47047, expiresIn: 60 * 24 * time.Hour, bindStatus: "OK"}
+	c := newTestClient(t, fake)
+	c.SetLogin("p1234567", "secret")
+
+	for i := 0; i < 2; i++ {
+		ports, err := c.PullPorts()
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if len(ports) != 1 || ports[0] != 47047 {
+			t.Errorf("Expected port 47047, got %v", ports)
+		}
+	}
+	tokens, signatures, binds := fake.counts()
+	if tokens != 1 || signatures != 1 || binds != 1 {
+		t.Errorf("Expected 1 token, 1 signature and 1 bind, got %d %d %d", tokens, signatures, binds)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	fake := &fakePIA{port: 47047, expiresIn: 60 * 24 * time.Hour, bindStatus: "OK"}
+	c := newTestClient(t, fake)
+	c.SetToken("static-token")
+	c.keepAlive = 20 * time.Millisecond
+
+	if _, err := c.PullPorts(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, _, binds := fake.counts(); binds >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tokens, signatures, binds := fake.counts()
+	if binds < 3 {
+		t.Errorf("Expected repeated bindPort keep-alives, got %d", binds)
+	}
+	if tokens != 0 || signatures != 1 {
+		t.Errorf("Expected a single signature from the static token, got %d tokens %d signatures", tokens, signatures)
+	}
+}
+
+func TestSignatureRefresh(t *testing.T) {
+	// expires inside the refresh margin, so every pull gets a new signature
+	fake := &fakePIA{port: 47047, expiresIn: time.Hour, bindStatus: "OK"}
+	c := newTestClient(t, fake)
+	c.SetToken("static-token")
+
+	c.PullPorts()
+	c.PullPorts()
+	_, signatures, binds := fake.counts()
+	if signatures != 2 || binds != 2 {
+		t.Errorf("Expected 2 signatures and 2 binds, got %d %d", signatures, binds)
+	}
+}
+
+func TestBindPortRejected(t *testing.T) {
+	fake := &fakePIA{port: 47047, expiresIn: 60 * 24 * time.Hour, bindStatus: "ERROR"}
+	c := newTestClient(t, fake)
+	c.SetToken("static-token")
+
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error when bindPort is rejected")
+	}
+	fake.mu.Lock()
+	fake.bindStatus = "OK"
+	fake.mu.Unlock()
+	if _, err := c.PullPorts(); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	// the rejected signature was dropped
+	if _, signatures, _ := fake.counts(); signatures != 2 {
+		t.Errorf("Expected a new signature after the rejected bind, got %d", signatures)
+	}
+}
+
+func TestBindPortUnreachable(t *testing.T) {
+	fake := &fakePIA{port: 47047, expiresIn: 60 * 24 * time.Hour, bindStatus: "OK", bindFails: 1}
+	c := newTestClient(t, fake)
+	c.SetToken("static-token")
+
+	if _, err := c.PullPorts(); err == nil || errors.Is(err, ErrBindRejected) {
+		t.Errorf("Expected a transport error, got %v", err)
+	}
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	// only bindPort is retried, the signature and its port are kept
+	if _, signatures, binds := fake.counts(); signatures != 1 || binds != 2 || ports[0] != 47047 {
+		t.Errorf("Expected 1 signature and 2 binds for port 47047, got %d %d %v", signatures, binds, ports)
+	}
+}
+
+func TestBadToken(t *testing.T) {
+	fake := &fakePIA{port: 47047, expiresIn: 60 * 24 * time.Hour, bindStatus: "OK"}
+	c := newTestClient(t, fake)
+	c.SetLogin("p1234567", "wrong")
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error for bad credentials")
+	}
+}
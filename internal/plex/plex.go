@@ -0,0 +1,165 @@
+package plex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Pushes the port to Plex Media Server as the manually specified public port of Remote Access
+type Client struct {
+	host   string
+	port   int
+	token  string
+	client *http.Client
+	Log    logging.Logger
+}
+
+type setting struct {
+	ID    string      `json:"id"`
+	Value interface{} `json:"value"`
+}
+
+type prefsResponse struct {
+	MediaContainer struct {
+		Setting []setting `json:"Setting"`
+	} `json:"MediaContainer"`
+}
+
+type preferences struct {
+	ManualPortMappingMode bool
+	ManualPortMappingPort int
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+}
+
+func NewClient(host string, port int, token string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "plex: "}
+	return &Client{
+		host:   host,
+		port:   port,
+		token:  token,
+		client: httpClient,
+		Log:    logger,
+	}
+}
+
+func (c *Client) newRequest(method string, query url.Values) (*http.Request, error) {
+	uri := fmt.Sprintf("http://%s:%d/:/prefs", c.host, c.port)
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-Plex-Token", c.token)
+	req.Header.Add("X-Plex-Client-Identifier", "portpusher")
+	req.Header.Add("X-Plex-Product", "Port Pusher")
+	return req, nil
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	prefs, err := c.getPreferences()
+	if err != nil {
+		return err
+	}
+	c.Log.Debug("getPreferences OK %v", prefs)
+
+	if prefs.ManualPortMappingPort == port && prefs.ManualPortMappingMode {
+		// nothing to do
+		c.Log.Info("Port is correct")
+	} else {
+		c.Log.Info("Pushing port %d, current port is %d", port, prefs.ManualPortMappingPort)
+		err = c.setPreferences(url.Values{
+			"ManualPortMappingMode": {"1"},
+			"ManualPortMappingPort": {strconv.Itoa(port)},
+		})
+		if err != nil {
+			return err
+		}
+		c.Log.Info("Port pushed")
+	}
+	return nil
+}
+
+func (c *Client) getPreferences() (*preferences, error) {
+	req, err := c.newRequest(http.MethodGet, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("token rejected")
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response %s", err)
+	}
+	var container prefsResponse
+	err = json.Unmarshal(data, &container)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal json: %s", err)
+	}
+
+	prefs := &preferences{}
+	for _, s := range container.MediaContainer.Setting {
+		switch s.ID {
+		case "ManualPortMappingMode":
+			prefs.ManualPortMappingMode = s.Value == true
+		case "ManualPortMappingPort":
+			if v, ok := s.Value.(float64); ok {
+				prefs.ManualPortMappingPort = int(v)
+			}
+		}
+	}
+	return prefs, nil
+}
+
+// Only the preferences present in the query are changed
+func (c *Client) setPreferences(prefs url.Values) error {
+	req, err := c.newRequest(http.MethodPut, prefs)
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+	return nil
+}
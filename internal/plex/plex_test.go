@@ -0,0 +1,103 @@
+package plex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process Plex Media Server preferences
+type fakePlex struct {
+	mode bool
+	port int
+	puts int
+}
+
+func (f *fakePlex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Plex-Token") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/:/prefs" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"MediaContainer": map[string]interface{}{
+			"size": 3,
+			"Setting": []map[string]interface{}{
+				{"id": "FriendlyName", "type": "text", "value": "plex"},
+				{"id": "ManualPortMappingMode", "type": "bool", "value": f.mode},
+				{"id": "ManualPortMappingPort", "type": "int", "value": f.port},
+			},
+		}})
+	case http.MethodPut:
+		q := r.URL.Query()
+		if v := q.Get("ManualPortMappingMode"); v != "" {
+			f.mode = v == "1"
+		}
+		if v := q.Get("ManualPortMappingPort"); v != "" {
+			f.port, _ = strconv.Atoi(v)
+		}
+		f.puts++
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestClient(t *testing.T, serverURL string, token string) *Client {
+	host, port := testutil.URLHostPort(t, serverURL)
+	return NewClient(host, port, token, http.DefaultClient, logging.NewLogger(logging.ERROR))
+}
+
+func TestPush(t *testing.T) {
+	f := &fakePlex{port: 32400}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "token")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.port != 44201 || !f.mode {
+		t.Errorf("Expected manual port 44201, got %d mode=%v", f.port, f.mode)
+	}
+
+	// already set, nothing is changed
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.puts != 1 {
+		t.Errorf("Expected a single preferences change, got %d", f.puts)
+	}
+}
+
+func TestPushEnablesManualMode(t *testing.T) {
+	f := &fakePlex{port: 44201}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "token")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if !f.mode {
+		t.Errorf("Expected manual port mapping to be enabled")
+	}
+}
+
+func TestPushTokenRejected(t *testing.T) {
+	server := httptest.NewServer(&fakePlex{})
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "wrong")
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error for rejected token")
+	}
+}
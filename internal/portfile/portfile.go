@@ -0,0 +1,150 @@
+package portfile
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/ports"
+)
+
+// Reads the forwarded port from a file written by a VPN container, e.g. Gluetun's /tmp/gluetun/forwarded_port.
+// The file is watched with inotify where available and polled otherwise, changes are reported on Changes().
+type Client struct {
+	path     string
+	format   string
+	parse    ports.Parser
+	interval time.Duration
+	Log      logging.Logger
+	mu       sync.Mutex
+	last     []int // ports seen by the watcher
+	changes  chan struct{}
+	stop     chan struct{}
+	watching bool
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("path=%s format=%s poll_interval=%v", c.path, c.format, c.interval)
+}
+
+// format only describes the parser in logs
+func NewClient(path string, format string, parse ports.Parser, interval time.Duration, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "file: "}
+	return &Client{
+		path:     path,
+		format:   format,
+		parse:    parse,
+		interval: interval,
+		Log:      logger,
+		changes:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Pull the forwarded ports from the file.
+// The first call starts watching the file for changes.
+func (c *Client) PullPorts() ([]int, error) {
+	c.startWatching()
+	ports, err := c.read()
+	if err != nil {
+		c.Log.Error("pull port error: %v", err)
+		return nil, err
+	}
+	c.mu.Lock()
+	c.last = ports
+	c.mu.Unlock()
+
+	if len(ports) == 1 {
+		c.Log.Info("Forwarded port is %d", ports[0])
+	} else {
+		c.Log.Info("Forwarded ports are %v", ports)
+	}
+	return ports, nil
+}
+
+// Receives a value whenever the ports in the file change
+func (c *Client) Changes() <-chan struct{} {
+	return c.changes
+}
+
+// Stops watching the file
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watching {
+		close(c.stop)
+		c.watching = false
+	}
+}
+
+func (c *Client) read() ([]int, error) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	c.Log.Debug("%s contains: %s", c.path, string(data))
+	ports, err := c.parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", c.path, err)
+	}
+	return ports, nil
+}
+
+func (c *Client) startWatching() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watching {
+		return
+	}
+	c.watching = true
+
+	events, err := watch(c.path, c.stop)
+	if err != nil {
+		c.Log.Warn("Cannot watch %s, polling every %v instead: %v", c.path, c.interval, err)
+		ticker := time.NewTicker(c.interval)
+		go func() {
+			<-c.stop
+			ticker.Stop()
+		}()
+		events = ticker.C
+	}
+	go c.run(events)
+}
+
+func (c *Client) run(events <-chan time.Time) {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-events:
+			c.check()
+		}
+	}
+}
+
+// Re-reads the file and signals Changes() when the ports differ from the last read
+func (c *Client) check() {
+	ports, err := c.read()
+	if err != nil {
+		// the VPN container may be rewriting the file, the next read will tell
+		c.Log.Debug("read error: %v", err)
+		return
+	}
+	c.mu.Lock()
+	changed := !slices.Equal(ports, c.last)
+	c.last = ports
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	c.Log.Info("Forwarded ports changed to %v", ports)
+	select {
+	case c.changes <- struct{}{}:
+	default:
+		// a change is already pending
+	}
+}
@@ -0,0 +1,86 @@
+package portfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/ports"
+)
+
+func waitForChange(t *testing.T, c *Client) {
+	select {
+	case <-c.Changes():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected a change notification")
+	}
+}
+
+func TestPullPortsAndWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forwarded_port")
+	if err := os.WriteFile(path, []byte("44201\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(path, "int", ports.IntParser(), time.Hour, logging.NewLogger(logging.ERROR))
+	defer c.Close()
+
+	forwarded, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(forwarded) != 1 || forwarded[0] != 44201 {
+		t.Errorf("Expected port 44201, got %v", forwarded)
+	}
+
+	// replaced through a rename, like most VPN containers do
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte("44202\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, c)
+
+	forwarded, err = c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if forwarded[0] != 44202 {
+		t.Errorf("Expected port 44202, got %v", forwarded)
+	}
+}
+
+func TestPollingFallback(t *testing.T) {
+	// the directory doesn't exist yet, so it can't be watched
+	dir := filepath.Join(t.TempDir(), "gluetun")
+	path := filepath.Join(dir, "forwarded_port")
+	parse, err := ports.JSONParser("$.port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(path, "json", parse, 20*time.Millisecond, logging.NewLogger(logging.ERROR))
+	defer c.Close()
+
+	if _, err := c.PullPorts(); err == nil {
+		t.Errorf("Expected error for a missing file")
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"port":44203}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, c)
+
+	forwarded, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if forwarded[0] != 44203 {
+		t.Errorf("Expected port 44203, got %v", forwarded)
+	}
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package portfile
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Watches the directory holding path with inotify, so files that are replaced rather than rewritten
+// (e.g. written to a temp file and renamed) are noticed too. Closing stop ends the watch.
+func watch(path string, stop <-chan struct{}) (<-chan time.Time, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_MODIFY)
+	if _, err = syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// a non-blocking fd is handled by the runtime poller, so Close unblocks Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	events := make(chan time.Time, 1)
+	go func() {
+		<-stop
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			if matches(buf[:n], name) {
+				select {
+				case events <- time.Now():
+				default:
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Reports whether any inotify event in buf is about the named file
+func matches(buf []byte, name string) bool {
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + syscall.SizeofInotifyEvent
+		end := start + int(event.Len)
+		if end > len(buf) {
+			return false
+		}
+		// the name is NUL padded
+		eventName := string(buf[start:end])
+		for i := 0; i < len(eventName); i++ {
+			if eventName[i] == 0 {
+				eventName = eventName[:i]
+				break
+			}
+		}
+		if eventName == name {
+			return true
+		}
+		offset = end
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package portfile
+
+import (
+	"errors"
+	"time"
+)
+
+// inotify is Linux only, other platforms poll
+func watch(path string, stop <-chan struct{}) (<-chan time.Time, error) {
+	return nil, errors.New("file watching is not supported on this platform")
+}
@@ -0,0 +1,137 @@
+package ports
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nanreh/portpusher/internal/jsonpath"
+)
+
+// Extracts an ordered set of ports from some text, e.g. a file or command output
+type Parser func(data []byte) ([]int, error)
+
+// Parses plain integers separated by whitespace or commas, e.g. Gluetun's forwarded_port file
+func IntParser() Parser {
+	return func(data []byte) ([]int, error) {
+		fields := strings.FieldsFunc(string(data), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+		})
+		ports := make([]int, 0, len(fields))
+		for _, f := range fields {
+			port, err := parsePort(f)
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, port)
+		}
+		return nonEmpty(ports)
+	}
+}
+
+// Parses a JSON document and reads the port(s) at a JSONPath-style expression, e.g. "port", "$.vpn.ports"
+// or "$.peers[*].port". The value can be a number, a numeric string or an array of them.
+func JSONParser(expr string) (Parser, error) {
+	path, err := jsonpath.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(data []byte) ([]int, error) {
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("could not unmarshal json: %s", err)
+		}
+		v, err := path.Get(doc)
+		if err != nil {
+			return nil, err
+		}
+		return FromJSON(v)
+	}, nil
+}
+
+// Parses every match of a regular expression. The first capture group holds the port,
+// or the whole match when there are no groups.
+func RegexParser(expr string) (Parser, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	group := 0
+	if re.NumSubexp() > 0 {
+		group = 1
+	}
+	return func(data []byte) ([]int, error) {
+		matches := re.FindAllSubmatch(data, -1)
+		ports := make([]int, 0, len(matches))
+		for _, m := range matches {
+			port, err := parsePort(string(m[group]))
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, port)
+		}
+		return nonEmpty(ports)
+	}, nil
+}
+
+// Converts a decoded JSON value (number, numeric string or array of them) to ports
+func FromJSON(v interface{}) ([]int, error) {
+	ports, err := fromJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return nonEmpty(ports)
+}
+
+func fromJSON(v interface{}) ([]int, error) {
+	switch t := v.(type) {
+	case float64:
+		port, err := parsePort(strconv.FormatFloat(t, 'f', -1, 64))
+		if err != nil {
+			return nil, err
+		}
+		return []int{port}, nil
+	case string:
+		port, err := parsePort(t)
+		if err != nil {
+			return nil, err
+		}
+		return []int{port}, nil
+	case []interface{}:
+		ports := make([]int, 0, len(t))
+		for _, i := range t {
+			p, err := fromJSON(i)
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, p...)
+		}
+		return ports, nil
+	default:
+		return nil, fmt.Errorf("expected a port but found %T %v", t, t)
+	}
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 0 || port > 65535 {
+		return -1, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// Drops zeros, which mean "no port" to most VPN tools, and fails when nothing is left
+func nonEmpty(ports []int) ([]int, error) {
+	out := ports[:0]
+	for _, p := range ports {
+		if p != 0 {
+			out = append(out, p)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no forwarded port found")
+	}
+	return out, nil
+}
@@ -0,0 +1,53 @@
+package ports
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParsers(t *testing.T) {
+	regex, err := RegexParser(`port=(\d+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonParser := func(expr string) Parser {
+		p, err := JSONParser(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tests := []struct {
+		name     string
+		parser   Parser
+		data     string
+		expected []int
+		isError  bool
+	}{
+		{"int", IntParser(), "44201\n", []int{44201}, false},
+		{"int multiple", IntParser(), "44201,44202\n44203", []int{44201, 44202, 44203}, false},
+		{"int zero", IntParser(), "0", nil, true},
+		{"int garbage", IntParser(), "port", nil, true},
+		{"json", jsonParser("port"), `{"port":44201}`, []int{44201}, false},
+		{"json nested", jsonParser("$.vpn.ports"), `{"vpn":{"ports":[44201,"44202",0]}}`, []int{44201, 44202}, false},
+		{"json missing", jsonParser("vpn.port"), `{"vpn":{}}`, nil, true},
+		{"json bool", jsonParser("$.port"), `{"port":true}`, nil, true},
+		{"regex", regex, "status=ok port=44201 port=44202", []int{44201, 44202}, false},
+		{"regex no match", regex, "status=down", nil, true},
+	}
+	for _, test := range tests {
+		ports, err := test.parser([]byte(test.data))
+		if test.isError {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", test.name, ports)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if fmt.Sprint(ports) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ports)
+		}
+	}
+}
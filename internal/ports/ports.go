@@ -0,0 +1,28 @@
+package ports
+
+import "fmt"
+
+// Picks the port a client should use from the ordered set of forwarded ports.
+// Index selects one of the forwarded ports, Offset is then added to it.
+// The zero value selects the first forwarded port unchanged.
+type Mapping struct {
+	Index  int
+	Offset int
+}
+
+// Stringer
+func (m Mapping) String() string {
+	return fmt.Sprintf("index=%d offset=%d", m.Index, m.Offset)
+}
+
+// Returns the port selected by this mapping
+func (m Mapping) Select(ports []int) (int, error) {
+	if m.Index < 0 || m.Index >= len(ports) {
+		return -1, fmt.Errorf("no forwarded port at index %d, %d port(s) available", m.Index, len(ports))
+	}
+	port := ports[m.Index] + m.Offset
+	if port <= 0 || port > 65535 {
+		return -1, fmt.Errorf("port %d with offset %d is out of range", ports[m.Index], m.Offset)
+	}
+	return port, nil
+}
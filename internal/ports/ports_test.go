@@ -0,0 +1,32 @@
+package ports
+
+import "testing"
+
+func TestSelect(t *testing.T) {
+	forwarded := []int{50000, 50001, 65535}
+	tests := []struct {
+		mapping  Mapping
+		expected int
+		isError  bool
+	}{
+		{Mapping{}, 50000, false},
+		{Mapping{Index: 1}, 50001, false},
+		{Mapping{Offset: 10}, 50010, false},
+		{Mapping{Index: 1, Offset: -1}, 50000, false},
+		{Mapping{Index: 3}, -1, true},
+		{Mapping{Index: -1}, -1, true},
+		{Mapping{Index: 2, Offset: 1}, -1, true},
+	}
+	for _, test := range tests {
+		port, err := test.mapping.Select(forwarded)
+		if test.isError && err == nil {
+			t.Errorf("%v: expected error, got port %d", test.mapping, port)
+		}
+		if !test.isError && err != nil {
+			t.Errorf("%v: got error %v", test.mapping, err)
+		}
+		if port != test.expected {
+			t.Errorf("%v: expected %d, got %d", test.mapping, test.expected, port)
+		}
+	}
+}
@@ -72,7 +72,7 @@ func (c *Client) doPush(port int) error {
 		c.Log.Info("Port is correct")
 	} else {
 		c.Log.Info("Pushing port %d, current port is %d", port, prefs.Port)
-		err = c.setPreferences(&preferences{Port: port, PortRandom: false})
+		err = c.setPreferences(map[string]interface{}{"listen_port": port, "random_port": false})
 		if err != nil {
 			return err
 		}
@@ -81,9 +81,45 @@ func (c *Client) doPush(port int) error {
 	return nil
 }
 
+// IPPusher
+func (c *Client) PushIP(ip string) error {
+	if err := c.doPushIP(ip); err != nil {
+		c.Log.Error("push announce IP error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPushIP(ip string) error {
+	if err := c.login(); err != nil {
+		return err
+	}
+	c.Log.Debug("login OK")
+
+	prefs, err := c.getPreferences()
+	if err != nil {
+		return err
+	}
+	c.Log.Debug("getPreferences OK %v", prefs)
+
+	if prefs.AnnounceIP == ip {
+		// nothing to do
+		c.Log.Info("Announce IP is correct")
+	} else {
+		c.Log.Info("Pushing announce IP %s, current announce IP is %s", ip, prefs.AnnounceIP)
+		err = c.setPreferences(map[string]interface{}{"announce_ip": ip})
+		if err != nil {
+			return err
+		}
+		c.Log.Info("Announce IP pushed")
+	}
+	return nil
+}
+
 type preferences struct {
-	Port       int  `json:"listen_port"`
-	PortRandom bool `json:"random_port"`
+	Port       int    `json:"listen_port"`
+	PortRandom bool   `json:"random_port"`
+	AnnounceIP string `json:"announce_ip"`
 }
 
 func (c *Client) login() error {
@@ -142,7 +178,8 @@ func (c *Client) getPreferences() (*preferences, error) {
 	return prefs, nil
 }
 
-func (c *Client) setPreferences(prefs *preferences) error {
+// Only the preferences present in the map are changed
+func (c *Client) setPreferences(prefs map[string]interface{}) error {
 	prefsJson, err := json.Marshal(prefs)
 	if err != nil {
 		return fmt.Errorf("failed to build HTTP request %s", err)
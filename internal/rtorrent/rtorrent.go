@@ -0,0 +1,113 @@
+package rtorrent
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Pushes the port to rTorrent over XML-RPC, either through a web server like ruTorrent's /RPC2 endpoint
+// (http:// and https:// URLs) or straight to rTorrent's SCGI socket (scgi://host:port and unix:///path URLs).
+type Client struct {
+	url    *url.URL
+	user   string
+	pass   string
+	client *http.Client
+	Log    logging.Logger
+}
+
+type portInfo struct {
+	PortRange  string
+	PortRandom bool
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("url=%s", c.url.Redacted())
+}
+
+func NewClient(rpcURL *url.URL, user string, pass string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "rtorrent: "}
+	return &Client{
+		url:    rpcURL,
+		user:   user,
+		pass:   pass,
+		client: httpClient,
+		Log:    logger,
+	}
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	info, err := c.getPortInfo()
+	if err != nil {
+		return fmt.Errorf("getPortInfo failed: %s", err)
+	}
+	c.Log.Debug("getPortInfo okay portInfo=%v", info)
+
+	want := fmt.Sprintf("%d-%d", port, port)
+	if info.PortRange == want && !info.PortRandom {
+		c.Log.Info("Port is correct")
+		return nil
+	}
+
+	c.Log.Info("Pushing port %d, current port range is %s", port, info.PortRange)
+	// rTorrent commands take a target as the first argument, empty for global settings
+	if info.PortRandom {
+		if _, err := c.call("network.port_random.set", "", 0); err != nil {
+			return fmt.Errorf("push failed: %w", err)
+		}
+	}
+	if _, err := c.call("network.port_range.set", "", want); err != nil {
+		return fmt.Errorf("push failed: %w", err)
+	}
+	c.Log.Info("Port pushed")
+	return nil
+}
+
+func (c *Client) getPortInfo() (*portInfo, error) {
+	portRange, err := c.call("network.port_range")
+	if err != nil {
+		return nil, err
+	}
+	random, err := c.call("network.port_random")
+	if err != nil {
+		return nil, err
+	}
+	return &portInfo{
+		PortRange:  portRange,
+		PortRandom: random == "1",
+	}, nil
+}
+
+// Calls an XML-RPC method and returns its result as text
+func (c *Client) call(method string, params ...interface{}) (string, error) {
+	body, err := encodeCall(method, params...)
+	if err != nil {
+		return "", err
+	}
+	c.Log.Debug("%s request=%s", method, string(body))
+
+	var data []byte
+	switch c.url.Scheme {
+	case "scgi", "unix":
+		data, err = c.postSCGI(body)
+	default:
+		data, err = c.postHTTP(body)
+	}
+	if err != nil {
+		return "", err
+	}
+	c.Log.Debug("%s response=%s", method, string(data))
+	return decodeResponse(data)
+}
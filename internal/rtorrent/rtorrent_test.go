@@ -0,0 +1,224 @@
+package rtorrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// In-process rTorrent that answers XML-RPC over HTTP and SCGI
+type fakeRtorrent struct {
+	mu         sync.Mutex
+	portRange  string
+	portRandom int
+	calls      []string
+}
+
+type call struct {
+	Method string `xml:"methodName"`
+	Params []struct {
+		Value value `xml:"value"`
+	} `xml:"params>param"`
+}
+
+func (f *fakeRtorrent) handle(body []byte) string {
+	var c call
+	if err := xml.Unmarshal(body, &c); err != nil {
+		return fault(-501, err.Error())
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, c.Method)
+	switch c.Method {
+	case "network.port_range":
+		return result("<string>" + f.portRange + "</string>")
+	case "network.port_random":
+		return result(fmt.Sprintf("<i8>%d</i8>", f.portRandom))
+	case "network.port_range.set", "network.port_random.set":
+		if len(c.Params) != 2 || c.Params[0].Value.text() != "" {
+			return fault(-503, "Wrong object type.")
+		}
+		v := c.Params[1].Value.text()
+		if c.Method == "network.port_range.set" {
+			f.portRange = v
+		} else {
+			f.portRandom, _ = strconv.Atoi(v)
+		}
+		return result("<i8>0</i8>")
+	default:
+		return fault(-506, "Method '"+c.Method+"' not defined")
+	}
+}
+
+func result(v string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?><methodResponse><params><param><value>` + v + `</value></param></params></methodResponse>`
+}
+
+func fault(code int, msg string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><methodResponse><fault><value><struct><member><name>faultCode</name><value><i4>%d</i4></value></member><member><name>faultString</name><value><string>%s</string></value></member></struct></value></fault></methodResponse>`, code, msg)
+}
+
+func (f *fakeRtorrent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, _ := r.BasicAuth()
+	if user != "rutorrent" || pass != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "text/xml")
+	io.WriteString(w, f.handle(body))
+}
+
+// Serves SCGI connections like rTorrent's network.scgi.open_port
+func (f *fakeRtorrent) serveSCGI(t *testing.T, l net.Listener) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			br := bufio.NewReader(conn)
+			size, err := br.ReadString(':')
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			n, _ := strconv.Atoi(strings.TrimSuffix(size, ":"))
+			headers := make([]byte, n+1) // netstring and trailing comma
+			io.ReadFull(br, headers)
+			fields := bytes.Split(headers[:n], []byte{0})
+			length, _ := strconv.Atoi(string(fields[1]))
+			body := make([]byte, length)
+			io.ReadFull(br, body)
+
+			res := f.handle(body)
+			fmt.Fprintf(conn, "Status: 200 OK\r\nContent-Type: text/xml\r\nContent-Length: %d\r\n\r\n%s", len(res), res)
+			conn.Close()
+		}
+	}()
+}
+
+func newTestClient(rawURL string, user string, pass string) *Client {
+	u, _ := url.Parse(rawURL)
+	return NewClient(u, user, pass, http.DefaultClient, logging.NewLogger(logging.ERROR))
+}
+
+func TestPushHTTP(t *testing.T) {
+	f := &fakeRtorrent{portRange: "6881-6999", portRandom: 1}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(server.URL+"/RPC2", "rutorrent", "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.portRange != "44201-44201" || f.portRandom != 0 {
+		t.Errorf("Expected port range 44201-44201 without random, got %s random=%d", f.portRange, f.portRandom)
+	}
+
+	// already set, nothing is changed
+	f.calls = nil
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(f.calls) != 2 {
+		t.Errorf("Expected only the two reads, got %v", f.calls)
+	}
+}
+
+func TestPushHTTPAuthRejected(t *testing.T) {
+	server := httptest.NewServer(&fakeRtorrent{})
+	defer server.Close()
+
+	c := newTestClient(server.URL+"/RPC2", "rutorrent", "wrong")
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error for rejected credentials")
+	}
+}
+
+func TestPushSCGI(t *testing.T) {
+	f := &fakeRtorrent{portRange: "6881-6999"}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.serveSCGI(t, l)
+
+	c := newTestClient("scgi://"+l.Addr().String(), "", "")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.portRange != "44201-44201" {
+		t.Errorf("Expected port range 44201-44201, got %s", f.portRange)
+	}
+	if len(f.calls) != 3 {
+		t.Errorf("Expected port_random to be left alone, got %v", f.calls)
+	}
+}
+
+func TestPushUnixSocket(t *testing.T) {
+	f := &fakeRtorrent{portRange: "44201-44201"}
+	path := filepath.Join(t.TempDir(), "rpc.socket")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.serveSCGI(t, l)
+
+	c := newTestClient("unix://"+path, "", "")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(f.calls) != 2 {
+		t.Errorf("Expected only the two reads, got %v", f.calls)
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	v, err := decodeResponse([]byte(result("6881-6999")))
+	if err != nil || v != "6881-6999" {
+		t.Errorf("Expected an untyped string value, got %q %v", v, err)
+	}
+	v, err = decodeResponse([]byte(result("<i4>1</i4>")))
+	if err != nil || v != "1" {
+		t.Errorf("Expected 1, got %q %v", v, err)
+	}
+
+	_, err = decodeResponse([]byte(fault(-506, "Method 'x' not defined")))
+	var f *Fault
+	if !errors.As(err, &f) || f.Code != -506 || f.String != "Method 'x' not defined" {
+		t.Errorf("Expected fault -506, got %v", err)
+	}
+}
+
+func TestEncodeCall(t *testing.T) {
+	body, err := encodeCall("network.port_range.set", "", "1-2&")
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	expected := `<?xml version="1.0"?><methodCall><methodName>network.port_range.set</methodName><params><param><value><string></string></value></param><param><value><string>1-2&amp;</string></value></param></params></methodCall>`
+	if string(body) != expected {
+		t.Errorf("Expected %s, got %s", expected, body)
+	}
+
+	scgi := encodeSCGI([]byte("abc"))
+	expectedSCGI := "62:CONTENT_LENGTH\x003\x00SCGI\x001\x00REQUEST_METHOD\x00POST\x00REQUEST_URI\x00/RPC2\x00,abc"
+	if string(scgi) != expectedSCGI {
+		t.Errorf("Expected %q, got %q", expectedSCGI, scgi)
+	}
+}
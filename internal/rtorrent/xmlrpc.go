@@ -0,0 +1,184 @@
+package rtorrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Builds an XML-RPC methodCall. Params can be strings or ints.
+func encodeCall(method string, params ...interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0"?><methodCall><methodName>`)
+	xml.EscapeText(&b, []byte(method))
+	b.WriteString(`</methodName><params>`)
+	for _, p := range params {
+		b.WriteString(`<param><value>`)
+		switch v := p.(type) {
+		case string:
+			b.WriteString(`<string>`)
+			xml.EscapeText(&b, []byte(v))
+			b.WriteString(`</string>`)
+		case int:
+			fmt.Fprintf(&b, `<i8>%d</i8>`, v)
+		default:
+			return nil, fmt.Errorf("unsupported XML-RPC param %T", p)
+		}
+		b.WriteString(`</value></param>`)
+	}
+	b.WriteString(`</params></methodCall>`)
+	return b.Bytes(), nil
+}
+
+type value struct {
+	String  *string `xml:"string"`
+	Int     *string `xml:"int"`
+	I4      *string `xml:"i4"`
+	I8      *string `xml:"i8"`
+	Boolean *string `xml:"boolean"`
+	Struct  *struct {
+		Members []struct {
+			Name  string `xml:"name"`
+			Value value  `xml:"value"`
+		} `xml:"member"`
+	} `xml:"struct"`
+	Text string `xml:",chardata"`
+}
+
+// Text of a scalar value, a value without a type is a string
+func (v *value) text() string {
+	for _, s := range []*string{v.String, v.Int, v.I4, v.I8, v.Boolean} {
+		if s != nil {
+			return strings.TrimSpace(*s)
+		}
+	}
+	return v.Text
+}
+
+func (v *value) member(name string) string {
+	if v.Struct == nil {
+		return ""
+	}
+	for _, m := range v.Struct.Members {
+		if m.Name == name {
+			return m.Value.text()
+		}
+	}
+	return ""
+}
+
+type methodResponse struct {
+	Params []value `xml:"params>param>value"`
+	Fault  *value  `xml:"fault>value"`
+}
+
+// Returned when rTorrent answers with an XML-RPC fault
+type Fault struct {
+	Code   int
+	String string
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("XML-RPC fault %d: %s", f.Code, f.String)
+}
+
+// Parses an XML-RPC methodResponse and returns its single result as text
+func decodeResponse(data []byte) (string, error) {
+	var res methodResponse
+	if err := xml.Unmarshal(data, &res); err != nil {
+		return "", fmt.Errorf("could not parse XML-RPC response: %s", err)
+	}
+	if res.Fault != nil {
+		code, _ := strconv.Atoi(res.Fault.member("faultCode"))
+		return "", &Fault{Code: code, String: res.Fault.member("faultString")}
+	}
+	if len(res.Params) != 1 {
+		return "", fmt.Errorf("expected 1 XML-RPC result, got %d", len(res.Params))
+	}
+	return res.Params[0].text(), nil
+}
+
+// Sends an XML-RPC request over HTTP, e.g. to ruTorrent's /RPC2 endpoint
+func (c *Client) postHTTP(body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	req.Header.Set("Content-Type", "text/xml")
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request error, got Http %d", res.StatusCode)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// Sends an XML-RPC request straight to rTorrent's SCGI socket, network.scgi.open_port or network.scgi.open_local
+func (c *Client) postSCGI(body []byte) ([]byte, error) {
+	network, address := "tcp", c.url.Host
+	if c.url.Scheme == "unix" {
+		network, address = "unix", c.url.Path
+	}
+	conn, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := conn.Write(encodeSCGI(body)); err != nil {
+		return nil, err
+	}
+	return decodeSCGI(conn)
+}
+
+// Wraps a request body in SCGI headers, a netstring followed by the body
+func encodeSCGI(body []byte) []byte {
+	var headers bytes.Buffer
+	for _, h := range [][2]string{
+		{"CONTENT_LENGTH", strconv.Itoa(len(body))},
+		{"SCGI", "1"},
+		{"REQUEST_METHOD", "POST"},
+		{"REQUEST_URI", "/RPC2"},
+	} {
+		headers.WriteString(h[0])
+		headers.WriteByte(0)
+		headers.WriteString(h[1])
+		headers.WriteByte(0)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d:", headers.Len())
+	b.Write(headers.Bytes())
+	b.WriteByte(',')
+	b.Write(body)
+	return b.Bytes()
+}
+
+// Reads a CGI style response: headers, a blank line and the body
+func decodeSCGI(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	headers, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("could not read SCGI response headers: %s", err)
+	}
+	if status := headers.Get("Status"); status != "" && !strings.HasPrefix(status, "200") {
+		return nil, fmt.Errorf("SCGI request error, got status %s", status)
+	}
+	return io.ReadAll(br)
+}
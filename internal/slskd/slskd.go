@@ -0,0 +1,203 @@
+package slskd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Pushes the Soulseek listen port to slskd through its REST API. slskd must run with
+// remote_configuration enabled for the API to accept option changes.
+type Client struct {
+	host         string
+	port         int
+	apiKey       string
+	client       *http.Client
+	Log          logging.Logger
+	pollInterval time.Duration // between server state checks while waiting for the reconnect
+	timeout      time.Duration // how long applying the port and reconnecting may take
+}
+
+type options struct {
+	Soulseek struct {
+		ListenPort int `json:"listenPort"`
+	} `json:"soulseek"`
+}
+
+type application struct {
+	PendingReconnect bool `json:"pendingReconnect"`
+}
+
+type server struct {
+	State       string `json:"state"`
+	IsConnected bool   `json:"isConnected"`
+	IsLoggedIn  bool   `json:"isLoggedIn"`
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+}
+
+func NewClient(host string, port int, apiKey string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "slskd: "}
+	return &Client{
+		host:         host,
+		port:         port,
+		apiKey:       apiKey,
+		client:       httpClient,
+		Log:          logger,
+		pollInterval: 2 * time.Second,
+		timeout:      time.Minute,
+	}
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	var opts options
+	if err := c.do(http.MethodGet, "/api/v0/options", nil, &opts); err != nil {
+		return fmt.Errorf("getOptions failed: %s", err)
+	}
+	c.Log.Debug("getOptions OK listenPort=%d", opts.Soulseek.ListenPort)
+
+	if opts.Soulseek.ListenPort == port {
+		// nothing to do
+		c.Log.Info("Port is correct")
+		return nil
+	}
+
+	c.Log.Info("Pushing port %d, current port is %d", port, opts.Soulseek.ListenPort)
+	// an overlay only carries the options to change
+	overlay := map[string]interface{}{"soulseek": map[string]interface{}{"listenPort": port}}
+	if err := c.do(http.MethodPatch, "/api/v0/options", overlay, nil); err != nil {
+		return fmt.Errorf("push failed: %s", err)
+	}
+
+	// slskd reloads its options in the background, the server state read right after the patch
+	// is still the one from before the change
+	deadline := time.Now().Add(c.timeout)
+	if err := c.waitApplied(port, deadline); err != nil {
+		return err
+	}
+
+	// slskd reconnects to the Soulseek server on its own when it can, otherwise it flags a pending reconnect
+	var app application
+	if err := c.do(http.MethodGet, "/api/v0/application", nil, &app); err != nil {
+		return fmt.Errorf("getApplication failed: %s", err)
+	}
+	if app.PendingReconnect {
+		c.Log.Debug("reconnecting to apply the new port")
+		if err := c.do(http.MethodDelete, "/api/v0/server", "Applying new listen port", nil); err != nil {
+			return fmt.Errorf("disconnect failed: %s", err)
+		}
+		if err := c.do(http.MethodPut, "/api/v0/server", nil, nil); err != nil {
+			return fmt.Errorf("connect failed: %s", err)
+		}
+	}
+
+	if err := c.waitOnline(deadline); err != nil {
+		return err
+	}
+	c.Log.Info("Port pushed")
+	return nil
+}
+
+// Polls the options until slskd reports the new listen port
+func (c *Client) waitApplied(port int, deadline time.Time) error {
+	for {
+		var opts options
+		err := c.do(http.MethodGet, "/api/v0/options", nil, &opts)
+		if err == nil && opts.Soulseek.ListenPort == port {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("slskd did not apply port %d after %v: %s", port, c.timeout, err)
+			}
+			return fmt.Errorf("slskd did not apply port %d after %v, listen port is %d", port, c.timeout, opts.Soulseek.ListenPort)
+		}
+		c.Log.Debug("waiting for options reload, listen port is %d", opts.Soulseek.ListenPort)
+		time.Sleep(c.pollInterval)
+	}
+}
+
+// Polls the server state until slskd is connected and logged in again
+func (c *Client) waitOnline(deadline time.Time) error {
+	for {
+		var s server
+		err := c.do(http.MethodGet, "/api/v0/server", nil, &s)
+		if err == nil && s.IsConnected && s.IsLoggedIn {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("slskd did not come back online after %v: %s", c.timeout, err)
+			}
+			return fmt.Errorf("slskd did not come back online after %v, server state is %s", c.timeout, s.State)
+		}
+		c.Log.Debug("waiting for reconnect, server state is %s", s.State)
+		time.Sleep(c.pollInterval)
+	}
+}
+
+// Sends a request with an optional JSON body and decodes the JSON response into v when v isn't nil
+func (c *Client) do(method string, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to build HTTP request %s", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d%s", c.host, c.port, path), reader)
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-API-Key", c.apiKey)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("API key rejected")
+	case res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("forbidden, is remote_configuration enabled in slskd?")
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response %s", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("could not unmarshal json: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package slskd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process slskd. Like slskd, option changes and reconnects happen in the background a moment
+// after the request that caused them.
+type fakeSlskd struct {
+	mu               sync.Mutex
+	listenPort       int
+	autoReconnect    bool
+	pendingReconnect bool
+	connected        bool
+	stayOffline      bool
+	ignorePatch      bool
+	calls            []string
+}
+
+const fakeDelay = 20 * time.Millisecond
+
+func (f *fakeSlskd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-API-Key") != "key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/v0/options":
+		json.NewEncoder(w).Encode(map[string]interface{}{"soulseek": map[string]interface{}{"listenPort": f.listenPort, "description": "x"}})
+	case "PATCH /api/v0/options":
+		var overlay options
+		json.NewDecoder(r.Body).Decode(&overlay)
+		if !f.ignorePatch {
+			time.AfterFunc(fakeDelay, func() { f.apply(overlay.Soulseek.ListenPort) })
+		}
+		w.WriteHeader(http.StatusOK)
+	case "GET /api/v0/application":
+		json.NewEncoder(w).Encode(map[string]interface{}{"pendingReconnect": f.pendingReconnect})
+	case "DELETE /api/v0/server":
+		f.connected = false
+		w.WriteHeader(http.StatusNoContent)
+	case "PUT /api/v0/server":
+		f.pendingReconnect = false
+		time.AfterFunc(fakeDelay, f.reconnect)
+		w.WriteHeader(http.StatusOK)
+	case "GET /api/v0/server":
+		state := "Disconnected"
+		if f.connected {
+			state = "Connected, LoggedIn"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"state": state, "isConnected": f.connected, "isLoggedIn": f.connected})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeSlskd) apply(port int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listenPort = port
+	if f.autoReconnect {
+		f.connected = false
+		time.AfterFunc(fakeDelay, f.reconnect)
+	} else {
+		f.pendingReconnect = true
+	}
+}
+
+func (f *fakeSlskd) reconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = !f.stayOffline
+}
+
+func newTestClient(t *testing.T, serverURL string, apiKey string) *Client {
+	host, port := testutil.URLHostPort(t, serverURL)
+	c := NewClient(host, port, apiKey, http.DefaultClient, logging.NewLogger(logging.ERROR))
+	c.pollInterval = time.Millisecond
+	c.timeout = time.Second
+	return c
+}
+
+func TestPushWaitsForReconnect(t *testing.T) {
+	f := &fakeSlskd{listenPort: 50300, connected: true, autoReconnect: true}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "key")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	if f.listenPort != 44201 || !f.connected {
+		t.Errorf("Expected listen port 44201 and online, got %d connected=%v", f.listenPort, f.connected)
+	}
+	f.calls = nil
+	f.mu.Unlock()
+
+	// already set, nothing is changed
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.calls) != 1 {
+		t.Errorf("Expected only the options read, got %v", f.calls)
+	}
+}
+
+func TestPushPendingReconnect(t *testing.T) {
+	f := &fakeSlskd{listenPort: 50300, connected: true}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "key")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pendingReconnect || !f.connected {
+		t.Errorf("Expected a reconnect, got calls %v", f.calls)
+	}
+}
+
+func TestPushNeverOnline(t *testing.T) {
+	f := &fakeSlskd{listenPort: 50300, connected: true, autoReconnect: true, stayOffline: true}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "key")
+	c.timeout = 100 * time.Millisecond
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error when slskd doesn't come back online")
+	}
+}
+
+func TestPushNeverApplied(t *testing.T) {
+	f := &fakeSlskd{listenPort: 50300, connected: true, ignorePatch: true}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "key")
+	c.timeout = 100 * time.Millisecond
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error when slskd doesn't apply the new port")
+	}
+}
+
+func TestPushAPIKeyRejected(t *testing.T) {
+	server := httptest.NewServer(&fakeSlskd{})
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "wrong")
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error for rejected API key")
+	}
+}
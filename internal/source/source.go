@@ -0,0 +1,182 @@
+package source
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Returned (wrapped) when a source or a control server answers HTTP 401 or 403.
+// Lets operators tell bad credentials apart from a VPN that is down.
+var ErrAuthRejected = errors.New("authentication rejected by server")
+
+// Where forwarded ports come from
+type Source interface {
+	PullPorts() ([]int, error)
+}
+
+// Implemented by sources that notice port changes between pulls
+type ChangeNotifier interface {
+	Changes() <-chan struct{}
+}
+
+// Public IP of the VPN session and, when the source knows it, where the VPN server is
+type PublicIP struct {
+	IP           string
+	Country      string
+	Region       string
+	City         string
+	Organization string
+}
+
+// Stringer
+func (p *PublicIP) String() string {
+	return fmt.Sprintf("ip=%s country=%s region=%s city=%s", p.IP, p.Country, p.Region, p.City)
+}
+
+// How much one result moves a health score. Scores run from 0 (always failing) to 1 (always working).
+const healthWeight = 0.5
+
+// Tries sources in priority order until one supplies a port.
+// Every source keeps a health score; a source that fails is skipped for a while, longer the worse its score,
+// so a flapping primary isn't retried on every cycle. When every source is skipped they are all tried anyway.
+// A chain of one source just pulls from it.
+type Chain struct {
+	members    []*member
+	backoff    time.Duration
+	maxBackoff time.Duration
+	Log        logging.Logger
+	now        func() time.Time
+	changes    chan struct{}
+	last       string
+}
+
+type member struct {
+	name    string
+	source  Source
+	score   float64
+	retryAt time.Time
+}
+
+// Stringer
+func (c *Chain) String() string {
+	names := make([]string, len(c.members))
+	for i, m := range c.members {
+		names[i] = m.name
+	}
+	return fmt.Sprintf("sources=%s backoff=%v", strings.Join(names, ","), c.backoff)
+}
+
+// backoff is how long a failed source with a perfect score is skipped, it doubles as the score halves
+func NewChain(backoff time.Duration, logger logging.Logger) *Chain {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "source: "}
+	return &Chain{
+		backoff:    backoff,
+		maxBackoff: 12 * backoff,
+		Log:        logger,
+		now:        time.Now,
+		changes:    make(chan struct{}, 1),
+	}
+}
+
+// Adds a source after the ones already in the chain
+func (c *Chain) Add(name string, s Source) {
+	c.members = append(c.members, &member{name: name, source: s, score: 1})
+	if n, ok := s.(ChangeNotifier); ok {
+		go c.forward(n.Changes())
+	}
+}
+
+// The sources in priority order
+func (c *Chain) Sources() []Source {
+	sources := make([]Source, len(c.members))
+	for i, m := range c.members {
+		sources[i] = m.source
+	}
+	return sources
+}
+
+// Name of the source that supplied the last port, empty if the last pull failed
+func (c *Chain) Last() string {
+	return c.last
+}
+
+// Receives a value whenever any source reports a port change
+func (c *Chain) Changes() <-chan struct{} {
+	return c.changes
+}
+
+func (c *Chain) forward(changes <-chan struct{}) {
+	for range changes {
+		select {
+		case c.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Pull ports from the first healthy source that has them
+func (c *Chain) PullPorts() ([]int, error) {
+	c.last = ""
+	now := c.now()
+	skipped := make([]*member, 0, len(c.members))
+	errs := make([]error, 0, len(c.members))
+
+	for _, m := range c.members {
+		if len(c.members) > 1 && now.Before(m.retryAt) {
+			c.Log.Debug("skipping %s, score=%.2f retry in %v", m.name, m.score, m.retryAt.Sub(now).Round(time.Second))
+			skipped = append(skipped, m)
+			continue
+		}
+		ports, err := c.pull(m, now)
+		if err == nil {
+			return ports, nil
+		}
+		errs = append(errs, err)
+	}
+
+	// every source that was tried failed, give the skipped ones a chance before giving up
+	for _, m := range skipped {
+		c.Log.Info("No healthy source has a port, trying %s", m.name)
+		ports, err := c.pull(m, now)
+		if err == nil {
+			return ports, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(c.members) > 1 {
+		c.Log.Error("No source supplied a port")
+	}
+	return nil, fmt.Errorf("no source supplied a port: %w", errors.Join(errs...))
+}
+
+func (c *Chain) pull(m *member, now time.Time) ([]int, error) {
+	ports, err := m.source.PullPorts()
+	if err != nil {
+		m.score *= 1 - healthWeight
+		m.retryAt = now.Add(c.backoffFor(m.score))
+		if len(c.members) > 1 {
+			c.Log.Warn("%s failed, score=%.2f, skipping it for %v", m.name, m.score, m.retryAt.Sub(now).Round(time.Second))
+		}
+		return nil, fmt.Errorf("%s: %w", m.name, err)
+	}
+	m.score += (1 - m.score) * healthWeight
+	m.retryAt = time.Time{}
+	c.last = m.name
+	if len(c.members) > 1 {
+		c.Log.Info("Port supplied by %s, score=%.2f", m.name, m.score)
+	}
+	return ports, nil
+}
+
+// Halving the score doubles the backoff
+func (c *Chain) backoffFor(score float64) time.Duration {
+	d := time.Duration(float64(c.backoff) * healthWeight / score)
+	if d > c.maxBackoff {
+		return c.maxBackoff
+	}
+	return d
+}
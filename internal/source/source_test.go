@@ -0,0 +1,163 @@
+package source
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+type fakeSource struct {
+	ports []int
+	err   error
+	pulls int
+}
+
+func (f *fakeSource) PullPorts() ([]int, error) {
+	f.pulls++
+	return f.ports, f.err
+}
+
+type fakeNotifier struct {
+	fakeSource
+	changes chan struct{}
+}
+
+func (f *fakeNotifier) Changes() <-chan struct{} {
+	return f.changes
+}
+
+func newTestChain() (*Chain, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewChain(10*time.Minute, logging.NewLogger(logging.ERROR))
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestChainPriority(t *testing.T) {
+	c, _ := newTestChain()
+	primary := &fakeSource{ports: []int{1000}}
+	secondary := &fakeSource{ports: []int{2000}}
+	c.Add("gluetun", primary)
+	c.Add("file", secondary)
+
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if ports[0] != 1000 || c.Last() != "gluetun" {
+		t.Errorf("Expected port 1000 from gluetun, got %v from %s", ports, c.Last())
+	}
+	if secondary.pulls != 0 {
+		t.Errorf("Expected the secondary source to be left alone, got %d pulls", secondary.pulls)
+	}
+}
+
+func TestChainFailover(t *testing.T) {
+	c, now := newTestChain()
+	primary := &fakeSource{err: errors.New("connection refused")}
+	secondary := &fakeSource{ports: []int{2000}}
+	c.Add("gluetun", primary)
+	c.Add("file", secondary)
+
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if ports[0] != 2000 || c.Last() != "file" {
+		t.Errorf("Expected port 2000 from file, got %v from %s", ports, c.Last())
+	}
+
+	// the failed primary is skipped until its backoff runs out
+	*now = now.Add(time.Minute)
+	c.PullPorts()
+	if primary.pulls != 1 {
+		t.Errorf("Expected the failed primary to be skipped, got %d pulls", primary.pulls)
+	}
+
+	// back in rotation after the backoff, and preferred again once it works
+	*now = now.Add(10 * time.Minute)
+	primary.err = nil
+	primary.ports = []int{1000}
+	ports, _ = c.PullPorts()
+	if ports[0] != 1000 || c.Last() != "gluetun" {
+		t.Errorf("Expected port 1000 from gluetun, got %v from %s", ports, c.Last())
+	}
+}
+
+func TestChainBackoffGrowsWithFailures(t *testing.T) {
+	c, now := newTestChain()
+	primary := &fakeSource{err: errors.New("no port")}
+	c.Add("gluetun", primary)
+	c.Add("file", &fakeSource{ports: []int{2000}})
+
+	c.PullPorts()
+	first := c.members[0].retryAt.Sub(*now)
+	*now = c.members[0].retryAt
+	c.PullPorts()
+	second := c.members[0].retryAt.Sub(*now)
+	if second <= first {
+		t.Errorf("Expected the backoff to grow, got %v then %v", first, second)
+	}
+
+	for i := 0; i < 10; i++ {
+		*now = c.members[0].retryAt
+		c.PullPorts()
+	}
+	if got := c.members[0].retryAt.Sub(*now); got != c.maxBackoff {
+		t.Errorf("Expected the backoff to be capped at %v, got %v", c.maxBackoff, got)
+	}
+}
+
+func TestChainTriesSkippedSourcesLast(t *testing.T) {
+	c, now := newTestChain()
+	primary := &fakeSource{err: errors.New("no port")}
+	secondary := &fakeSource{err: errors.New("no file")}
+	c.Add("gluetun", primary)
+	c.Add("file", secondary)
+
+	if _, err := c.PullPorts(); err == nil {
+		t.Fatalf("Expected an error when every source fails")
+	}
+	if c.Last() != "" {
+		t.Errorf("Expected no supplying source, got %s", c.Last())
+	}
+
+	// both are backing off, but the primary recovered
+	*now = now.Add(time.Minute)
+	primary.err = nil
+	primary.ports = []int{1000}
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if ports[0] != 1000 {
+		t.Errorf("Expected port 1000, got %v", ports)
+	}
+}
+
+func TestChainSingleSourceNeverSkipped(t *testing.T) {
+	c, _ := newTestChain()
+	only := &fakeSource{err: errors.New("no port")}
+	c.Add("gluetun", only)
+	c.PullPorts()
+	c.PullPorts()
+	if only.pulls != 2 {
+		t.Errorf("Expected 2 pulls, got %d", only.pulls)
+	}
+}
+
+func TestChainChanges(t *testing.T) {
+	c, _ := newTestChain()
+	n := &fakeNotifier{changes: make(chan struct{}, 1)}
+	c.Add("gluetun", &fakeSource{})
+	c.Add("file", n)
+
+	n.changes <- struct{}{}
+	select {
+	case <-c.Changes():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected a change notification")
+	}
+}
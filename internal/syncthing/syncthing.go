@@ -0,0 +1,153 @@
+package syncthing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Pushes the port into the tcp:// and quic:// listen addresses of Syncthing through its REST config API
+type Client struct {
+	host   string
+	port   int
+	apiKey string
+	client *http.Client
+	Log    logging.Logger
+}
+
+type options struct {
+	ListenAddresses []string `json:"listenAddresses"`
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+}
+
+func NewClient(host string, port int, apiKey string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "syncthing: "}
+	return &Client{
+		host:   host,
+		port:   port,
+		apiKey: apiKey,
+		client: httpClient,
+		Log:    logger,
+	}
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	var opts options
+	if err := c.do(http.MethodGet, nil, &opts); err != nil {
+		return fmt.Errorf("getOptions failed: %s", err)
+	}
+	c.Log.Debug("getOptions OK listenAddresses=%v", opts.ListenAddresses)
+
+	addresses, found := rewriteListenAddresses(opts.ListenAddresses, port)
+	if found == 0 {
+		return fmt.Errorf("no tcp:// or quic:// listen address to update, set Syncthing's listen addresses to e.g. tcp://0.0.0.0:22000, quic://0.0.0.0:22000, default")
+	}
+	if slices.Equal(addresses, opts.ListenAddresses) {
+		// nothing to do
+		c.Log.Info("Port is correct")
+		return nil
+	}
+
+	c.Log.Info("Pushing port %d, current listen addresses are %s", port, strings.Join(opts.ListenAddresses, ", "))
+	if err := c.do(http.MethodPatch, &options{ListenAddresses: addresses}, nil); err != nil {
+		return fmt.Errorf("push failed: %s", err)
+	}
+	c.Log.Info("Port pushed")
+	return nil
+}
+
+// Sets the port of every tcp and quic address, e.g. tcp://0.0.0.0:22000 or quic6://[::]:22000?opt=x.
+// Other entries like default, relay:// and dynamic+https:// are kept as they are.
+// Returns the new addresses and how many of them are tcp or quic.
+func rewriteListenAddresses(addresses []string, port int) ([]string, int) {
+	rewritten := make([]string, len(addresses))
+	found := 0
+	for i, address := range addresses {
+		rewritten[i] = address
+		u, err := url.Parse(address)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimRight(u.Scheme, "46") {
+		case "tcp", "quic":
+		default:
+			continue
+		}
+		found++
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = strings.Trim(u.Host, "[]") // no port yet
+		}
+		u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+		rewritten[i] = u.String()
+	}
+	return rewritten, found
+}
+
+// Sends a request to /rest/config/options with an optional JSON body and decodes the JSON response into v when v isn't nil
+func (c *Client) do(method string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to build HTTP request %s", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d/rest/config/options", c.host, c.port), reader)
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	req.Header.Add("X-API-Key", c.apiKey)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("API key rejected")
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response %s", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("could not unmarshal json: %s", err)
+	}
+	return nil
+}
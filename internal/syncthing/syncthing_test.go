@@ -0,0 +1,119 @@
+package syncthing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process Syncthing config API
+type fakeSyncthing struct {
+	options map[string]interface{}
+	patches int
+}
+
+func (f *fakeSyncthing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-API-Key") != "key" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.URL.Path != "/rest/config/options" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(f.options)
+	case http.MethodPatch:
+		var changes map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&changes)
+		for k, v := range changes {
+			f.options[k] = v
+		}
+		f.patches++
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestClient(t *testing.T, serverURL string, apiKey string) *Client {
+	host, port := testutil.URLHostPort(t, serverURL)
+	return NewClient(host, port, apiKey, http.DefaultClient, logging.NewLogger(logging.ERROR))
+}
+
+func TestPush(t *testing.T) {
+	f := &fakeSyncthing{options: map[string]interface{}{
+		"listenAddresses":       []string{"tcp://0.0.0.0:22000", "quic://0.0.0.0:22000", "default", "dynamic+https://relays.syncthing.net/endpoint"},
+		"globalAnnounceEnabled": true,
+	}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "key")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	expected := []interface{}{"tcp://0.0.0.0:44201", "quic://0.0.0.0:44201", "default", "dynamic+https://relays.syncthing.net/endpoint"}
+	if !slices.Equal(f.options["listenAddresses"].([]interface{}), expected) {
+		t.Errorf("Expected %v, got %v", expected, f.options["listenAddresses"])
+	}
+
+	// already set, nothing is changed
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.patches != 1 {
+		t.Errorf("Expected a single options change, got %d", f.patches)
+	}
+}
+
+func TestPushOnlyDefault(t *testing.T) {
+	f := &fakeSyncthing{options: map[string]interface{}{"listenAddresses": []string{"default"}}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "key")
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error without tcp or quic listen addresses")
+	}
+	if f.patches != 0 {
+		t.Errorf("Expected default to be left alone")
+	}
+}
+
+func TestPushAPIKeyRejected(t *testing.T) {
+	server := httptest.NewServer(&fakeSyncthing{})
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "wrong")
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error for rejected API key")
+	}
+}
+
+func TestRewriteListenAddresses(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{"tcp://0.0.0.0:22000", "tcp://0.0.0.0:44201"},
+		{"tcp4://:22000", "tcp4://:44201"},
+		{"tcp6://[::]:22000", "tcp6://[::]:44201"},
+		{"quic://192.168.1.2:22000?reuse=1", "quic://192.168.1.2:44201?reuse=1"},
+		{"tcp://0.0.0.0", "tcp://0.0.0.0:44201"},
+		{"default", "default"},
+		{"relay://relay.example.com:22067/?id=ABC", "relay://relay.example.com:22067/?id=ABC"},
+		{"dynamic+https://relays.syncthing.net/endpoint", "dynamic+https://relays.syncthing.net/endpoint"},
+	}
+	for _, test := range tests {
+		got, _ := rewriteListenAddresses([]string{test.address}, 44201)
+		if got[0] != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.address, test.expected, got[0])
+		}
+	}
+}
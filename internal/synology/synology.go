@@ -0,0 +1,244 @@
+package synology
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Pushes the BitTorrent listening port to Synology Download Station through the DSM web API
+type Client struct {
+	host   string
+	port   int
+	user   string
+	pass   string
+	client *http.Client
+	Log    logging.Logger
+	mu     sync.Mutex
+	// whether the jar holds a session, it's reused until DSM rejects it
+	loggedIn bool
+}
+
+// Returned when DSM answers with success=false
+type APIError struct {
+	API  string
+	Code int
+}
+
+func (e *APIError) Error() string {
+	switch e.Code {
+	case 105:
+		return fmt.Sprintf("%s error 105: permission denied", e.API)
+	case 106, 107, 119:
+		return fmt.Sprintf("%s error %d: session expired", e.API, e.Code)
+	case 400:
+		return fmt.Sprintf("%s error 400: wrong account or password", e.API)
+	case 403:
+		return fmt.Sprintf("%s error 403: 2-factor authentication is required", e.API)
+	}
+	return fmt.Sprintf("%s error %d", e.API, e.Code)
+}
+
+// Whether DSM dropped the session, e.g. after a timeout or a restart
+func sessionExpired(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == 106 || apiErr.Code == 107 || apiErr.Code == 119
+}
+
+type response struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	Error   struct {
+		Code int `json:"code"`
+	} `json:"error"`
+}
+
+type btSettings struct {
+	TCPPort int `json:"tcp_port"`
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+}
+
+func NewClient(host string, port int, user string, pass string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "synology: "}
+	return &Client{
+		host:   host,
+		port:   port,
+		user:   user,
+		pass:   pass,
+		client: httpClient,
+		Log:    logger,
+	}
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	return req, nil
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.login(); err != nil {
+		return err
+	}
+	settings, err := c.getBTSettings()
+	if sessionExpired(err) {
+		c.Log.Debug("session expired, logging in again")
+		c.loggedIn = false
+		if err := c.login(); err != nil {
+			return err
+		}
+		settings, err = c.getBTSettings()
+	}
+	if err != nil {
+		return err
+	}
+	c.Log.Debug("getBTSettings OK %v", settings)
+
+	if settings.TCPPort == port {
+		// nothing to do
+		c.Log.Info("Port is correct")
+	} else {
+		c.Log.Info("Pushing port %d, current port is %d", port, settings.TCPPort)
+		err = c.setBTSettings(url.Values{"tcp_port": {strconv.Itoa(port)}})
+		if err != nil {
+			return err
+		}
+		c.Log.Info("Port pushed")
+	}
+	return nil
+}
+
+// Logs out of DSM, so the session doesn't linger until it times out
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loggedIn {
+		return
+	}
+	data := url.Values{}
+	data.Set("api", "SYNO.API.Auth")
+	data.Set("version", "3")
+	data.Set("method", "logout")
+	data.Set("session", "DownloadStation")
+	if _, err := c.call("/webapi/auth.cgi", data); err != nil {
+		c.Log.Warn("logout error: %v", err)
+	}
+	c.loggedIn = false
+}
+
+// With format=cookie DSM answers with an id cookie that the cookie jar keeps for the following requests.
+// Does nothing while logged in. Must hold c.mu.
+func (c *Client) login() error {
+	if c.loggedIn {
+		return nil
+	}
+	data := url.Values{}
+	data.Set("api", "SYNO.API.Auth")
+	data.Set("version", "3")
+	data.Set("method", "login")
+	data.Set("account", c.user)
+	data.Set("passwd", c.pass)
+	data.Set("session", "DownloadStation")
+	data.Set("format", "cookie")
+	if _, err := c.call("/webapi/auth.cgi", data); err != nil {
+		return err
+	}
+	c.Log.Debug("login OK")
+	c.loggedIn = true
+	return nil
+}
+
+func (c *Client) getBTSettings() (*btSettings, error) {
+	data := url.Values{}
+	data.Set("api", "SYNO.DownloadStation2.Settings.BT")
+	data.Set("version", "1")
+	data.Set("method", "get")
+	res, err := c.call("/webapi/entry.cgi", data)
+	if err != nil {
+		return nil, err
+	}
+	var settings *btSettings
+	err = json.Unmarshal(res, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal json: %s", err)
+	}
+	return settings, nil
+}
+
+// Only the settings present in the values are changed
+func (c *Client) setBTSettings(settings url.Values) error {
+	data := url.Values{}
+	data.Set("api", "SYNO.DownloadStation2.Settings.BT")
+	data.Set("version", "1")
+	data.Set("method", "set")
+	for k, v := range settings {
+		data[k] = v
+	}
+	_, err := c.call("/webapi/entry.cgi", data)
+	return err
+}
+
+// Posts a DSM web API request and returns its data
+func (c *Client) call(path string, data url.Values) (json.RawMessage, error) {
+	uri := fmt.Sprintf("http://%s:%d%s", c.host, c.port, path)
+	req, err := c.newRequest(http.MethodPost, uri, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request error, got HTTP %d", res.StatusCode)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response %s", err)
+	}
+	var dsmRes response
+	err = json.Unmarshal(body, &dsmRes)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal json: %s", err)
+	}
+	if !dsmRes.Success {
+		return nil, &APIError{API: data.Get("api"), Code: dsmRes.Error.Code}
+	}
+	return dsmRes.Data, nil
+}
@@ -0,0 +1,161 @@
+package synology
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process DSM web API with Download Station
+type fakeDSM struct {
+	tcpPort int
+	sets    int
+	sid     string // current session, empty when there is none
+	logins  int
+	logouts int
+}
+
+func reply(w http.ResponseWriter, data interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+}
+
+func replyError(w http.ResponseWriter, code int) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": map[string]interface{}{"code": code}})
+}
+
+func (f *fakeDSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	switch {
+	case r.URL.Path == "/webapi/auth.cgi" && r.Form.Get("api") == "SYNO.API.Auth" && r.Form.Get("method") == "login":
+		if r.Form.Get("account") != "admin" || r.Form.Get("passwd") != "secret" {
+			replyError(w, 400)
+			return
+		}
+		f.logins++
+		f.sid = "sid" + strconv.Itoa(f.logins)
+		if r.Form.Get("format") == "cookie" {
+			http.SetCookie(w, &http.Cookie{Name: "id", Value: f.sid, Path: "/"})
+		}
+		reply(w, map[string]interface{}{"sid": f.sid})
+		return
+	case r.URL.Path == "/webapi/auth.cgi" && r.Form.Get("api") == "SYNO.API.Auth" && r.Form.Get("method") == "logout":
+		if cookie, err := r.Cookie("id"); err == nil && cookie.Value == f.sid {
+			f.sid = ""
+			f.logouts++
+		}
+		reply(w, nil)
+		return
+	case r.URL.Path != "/webapi/entry.cgi":
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if cookie, err := r.Cookie("id"); err != nil || f.sid == "" || cookie.Value != f.sid {
+		replyError(w, 119)
+		return
+	}
+	if r.Form.Get("api") != "SYNO.DownloadStation2.Settings.BT" {
+		replyError(w, 102)
+		return
+	}
+	switch r.Form.Get("method") {
+	case "get":
+		reply(w, map[string]interface{}{"tcp_port": f.tcpPort, "enable_dht": true})
+	case "set":
+		f.tcpPort, _ = strconv.Atoi(r.Form.Get("tcp_port"))
+		f.sets++
+		reply(w, nil)
+	default:
+		replyError(w, 103)
+	}
+}
+
+func newTestClient(t *testing.T, serverURL string, user string, pass string) *Client {
+	host, port := testutil.URLHostPort(t, serverURL)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(host, port, user, pass, &http.Client{Jar: jar}, logging.NewLogger(logging.ERROR))
+}
+
+func TestPush(t *testing.T) {
+	f := &fakeDSM{tcpPort: 16881}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "admin", "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.tcpPort != 44201 {
+		t.Errorf("Expected BT port 44201, got %d", f.tcpPort)
+	}
+
+	// already set, nothing is changed
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.sets != 1 {
+		t.Errorf("Expected a single settings change, got %d", f.sets)
+	}
+	if f.logins != 1 {
+		t.Errorf("Expected the session to be reused, got %d logins", f.logins)
+	}
+
+	c.Close()
+	if f.logouts != 1 {
+		t.Errorf("Expected a logout on Close, got %d", f.logouts)
+	}
+}
+
+func TestPushSessionExpired(t *testing.T) {
+	f := &fakeDSM{tcpPort: 16881}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "admin", "secret")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	// DSM restarted, the session is gone
+	f.sid = ""
+	if err := c.Push(44202); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.tcpPort != 44202 || f.logins != 2 {
+		t.Errorf("Expected BT port 44202 after a new login, got %d with %d logins", f.tcpPort, f.logins)
+	}
+}
+
+func TestPushLoginRejected(t *testing.T) {
+	server := httptest.NewServer(&fakeDSM{})
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "admin", "wrong")
+	err := c.Push(44201)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 400 || apiErr.API != "SYNO.API.Auth" {
+		t.Errorf("Expected SYNO.API.Auth error 400, got %v", err)
+	}
+}
+
+func TestPushWithoutCookieJar(t *testing.T) {
+	server := httptest.NewServer(&fakeDSM{})
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "admin", "secret")
+	c.client = http.DefaultClient
+	err := c.Push(44201)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 119 {
+		t.Errorf("Expected session error 119, got %v", err)
+	}
+}
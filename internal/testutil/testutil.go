@@ -0,0 +1,32 @@
+package testutil
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// Splits a listener address like 127.0.0.1:44201 for clients that take a host and a port
+func HostPort(t testing.TB, addr string) (string, int) {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+// The host and port of a test server URL like http://127.0.0.1:44201
+func URLHostPort(t testing.TB, rawURL string) (string, int) {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return HostPort(t, u.Host)
+}
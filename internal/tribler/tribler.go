@@ -0,0 +1,158 @@
+package tribler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+// Pushes the libtorrent listen port to Tribler through its core REST API
+type Client struct {
+	client *http.Client
+	host   string
+	port   int
+	apiKey string
+	Log    logging.Logger
+}
+
+type libtorrentSettings struct {
+	Port int `json:"port"`
+}
+
+type settings struct {
+	Libtorrent libtorrentSettings `json:"libtorrent"`
+}
+
+type settingsResponse struct {
+	Settings settings `json:"settings"`
+}
+
+type setResponse struct {
+	Modified bool `json:"modified"`
+}
+
+// Stringer
+func (c *Client) String() string {
+	return fmt.Sprintf("host=%s port=%d", c.host, c.port)
+}
+
+func NewClient(host string, port int, apiKey string, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "tribler: "}
+	return &Client{
+		host:   host,
+		port:   port,
+		apiKey: apiKey,
+		client: httpClient,
+		Log:    logger,
+	}
+}
+
+func (c *Client) newRequest(method string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d/settings", c.host, c.port), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "Port Pusher")
+	req.Header.Add("X-Api-Key", c.apiKey)
+	return req, nil
+}
+
+// PortPusher
+func (c *Client) Push(port int) error {
+	if err := c.doPush(port); err != nil {
+		c.Log.Error("push error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) doPush(port int) error {
+	current, err := c.getPort()
+	if err != nil {
+		return fmt.Errorf("getPort failed: %s", err)
+	}
+	c.Log.Debug("getPort okay port=%d", current)
+
+	if err = c.pushPort(port, current); err != nil {
+		return fmt.Errorf("push failed: %s", err)
+	}
+	c.Log.Debug("push OK")
+	return nil
+}
+
+func (c *Client) getPort() (int, error) {
+	req, err := c.newRequest(http.MethodGet, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return 0, fmt.Errorf("API key rejected")
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HTTP request error, got Http %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading response %s", err)
+	}
+	var trResp *settingsResponse
+	err = json.Unmarshal(data, &trResp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unmarshal HTTP body: %s", err)
+	}
+	return trResp.Settings.Libtorrent.Port, nil
+}
+
+func (c *Client) pushPort(port int, current int) error {
+	if current == port {
+		c.Log.Info("Port is correct")
+		return nil
+	}
+	c.Log.Info("Pushing port %d, current port is %d", port, current)
+	// Tribler only changes the settings present in the body
+	out, err := json.Marshal(settings{Libtorrent: libtorrentSettings{Port: port}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal HTTP body %s", err)
+	}
+	c.Log.Debug("pushPort request=%v", string(out))
+	req, err := c.newRequest(http.MethodPost, bytes.NewBuffer(out))
+	if err != nil {
+		return fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request error, got Http %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response %s", err)
+	}
+	var trResp *setResponse
+	err = json.Unmarshal(data, &trResp)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal HTTP body: %s", err)
+	}
+	c.Log.Debug("pushPort OK response=%v", trResp)
+	c.Log.Info("Port pushed")
+	return nil
+}
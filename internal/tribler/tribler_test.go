@@ -0,0 +1,83 @@
+package tribler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/testutil"
+)
+
+// In-process Tribler core settings endpoint
+type fakeTribler struct {
+	settings map[string]map[string]interface{}
+	posts    int
+}
+
+func (f *fakeTribler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Api-Key") != "key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/settings" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"settings": f.settings})
+	case http.MethodPost:
+		var changes map[string]map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&changes)
+		for section, values := range changes {
+			for k, v := range values {
+				f.settings[section][k] = v
+			}
+		}
+		f.posts++
+		json.NewEncoder(w).Encode(map[string]interface{}{"modified": true})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestClient(t *testing.T, serverURL string, apiKey string) *Client {
+	host, port := testutil.URLHostPort(t, serverURL)
+	return NewClient(host, port, apiKey, http.DefaultClient, logging.NewLogger(logging.ERROR))
+}
+
+func TestPush(t *testing.T) {
+	f := &fakeTribler{settings: map[string]map[string]interface{}{
+		"libtorrent": {"port": 7000, "max_connections_download": -1},
+	}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "key")
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.settings["libtorrent"]["port"] != float64(44201) || f.settings["libtorrent"]["max_connections_download"] != -1 {
+		t.Errorf("Expected libtorrent port 44201, got %v", f.settings)
+	}
+
+	// already set, nothing is changed
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if f.posts != 1 {
+		t.Errorf("Expected a single settings change, got %d", f.posts)
+	}
+}
+
+func TestPushAPIKeyRejected(t *testing.T) {
+	server := httptest.NewServer(&fakeTribler{})
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "wrong")
+	if err := c.Push(44201); err == nil {
+		t.Errorf("Expected error for rejected API key")
+	}
+}
@@ -0,0 +1,253 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ssdpMulticast = "239.255.255.250:1900"
+
+// Device types searched for over SSDP
+var searchTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+// WAN services able to map ports, in order of preference
+var serviceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP error codes the client reacts to
+const (
+	codeConflict      = 718 // ConflictInMappingEntry
+	codePermanentOnly = 725 // OnlyPermanentLeasesSupported
+)
+
+// Returned (wrapped) when the router answers a SOAP action with a UPnP error
+type SOAPError struct {
+	Action      string
+	Code        int
+	Description string
+}
+
+func (e *SOAPError) Error() string {
+	return fmt.Sprintf("%s failed with UPnP error %d (%s)", e.Action, e.Code, e.Description)
+}
+
+// Sends an SSDP M-SEARCH to addr and returns the description URL of the first gateway that answers
+func discover(addr string, timeout time.Duration) (string, error) {
+	dst, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	for _, st := range searchTargets {
+		req := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpMulticast + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + st + "\r\n\r\n"
+		if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+			return "", err
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return "", fmt.Errorf("no Internet gateway answered SSDP discovery within %v", timeout)
+			}
+			return "", err
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		if location := res.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+type rootDesc struct {
+	URLBase string `xml:"URLBase"`
+	Device  device `xml:"device"`
+}
+
+type device struct {
+	DeviceType string    `xml:"deviceType"`
+	Services   []service `xml:"serviceList>service"`
+	Devices    []device  `xml:"deviceList>device"`
+}
+
+type service struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+func (d *device) find(serviceType string) *service {
+	for i := range d.Services {
+		if d.Services[i].ServiceType == serviceType {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].find(serviceType); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// Finds the control URL and type of the WAN connection service in a device description
+func parseDescription(data []byte, location string) (string, string, error) {
+	var root rootDesc
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return "", "", fmt.Errorf("could not parse device description: %s", err)
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return "", "", err
+		}
+	}
+	for _, st := range serviceTypes {
+		if s := root.Device.find(st); s != nil {
+			control, err := base.Parse(strings.TrimSpace(s.ControlURL))
+			if err != nil {
+				return "", "", err
+			}
+			return control.String(), st, nil
+		}
+	}
+	return "", "", fmt.Errorf("%s has no WAN connection service", location)
+}
+
+type arg struct {
+	name  string
+	value string
+}
+
+type soapEnvelope struct {
+	Body struct {
+		Fault *struct {
+			Detail struct {
+				Error struct {
+					Code        int    `xml:"errorCode"`
+					Description string `xml:"errorDescription"`
+				} `xml:"UPnPError"`
+			} `xml:"detail"`
+		} `xml:"Fault"`
+		Inner []byte `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+// Calls a SOAP action on the WAN connection service and returns the inner XML of the response body
+func (c *Client) call(action string, args ...arg) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>`)
+	b.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&b, `<u:%s xmlns:u="%s">`, action, c.serviceType)
+	for _, a := range args {
+		fmt.Fprintf(&b, "<%s>", a.name)
+		xml.EscapeText(&b, []byte(a.value))
+		fmt.Fprintf(&b, "</%s>", a.name)
+	}
+	fmt.Fprintf(&b, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, c.control, strings.NewReader(b.String()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP request %s", err)
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, c.serviceType, action))
+	req.Header.Add("User-Agent", "Port Pusher")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", action, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response %s", err)
+	}
+	c.Log.Debug("%s response: %s", action, string(data))
+
+	var env soapEnvelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s failed. HTTP status: %d", action, res.StatusCode)
+		}
+		return nil, fmt.Errorf("could not parse %s response: %s", action, err)
+	}
+	if env.Body.Fault != nil {
+		e := env.Body.Fault.Detail.Error
+		return nil, &SOAPError{Action: action, Code: e.Code, Description: e.Description}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed. HTTP status: %d", action, res.StatusCode)
+	}
+	return env.Body.Inner, nil
+}
+
+func (c *Client) addPortMapping(port int, protocol string, lease time.Duration) error {
+	_, err := c.call("AddPortMapping",
+		arg{"NewRemoteHost", ""},
+		arg{"NewExternalPort", strconv.Itoa(port)},
+		arg{"NewProtocol", protocol},
+		arg{"NewInternalPort", strconv.Itoa(port)},
+		arg{"NewInternalClient", c.internalClient},
+		arg{"NewEnabled", "1"},
+		arg{"NewPortMappingDescription", c.description},
+		arg{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+	)
+	return err
+}
+
+func (c *Client) deletePortMapping(port int, protocol string) error {
+	_, err := c.call("DeletePortMapping",
+		arg{"NewRemoteHost", ""},
+		arg{"NewExternalPort", strconv.Itoa(port)},
+		arg{"NewProtocol", protocol},
+	)
+	return err
+}
+
+func (c *Client) getExternalIPAddress() (string, error) {
+	inner, err := c.call("GetExternalIPAddress")
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		IP string `xml:"NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(inner, &res); err != nil {
+		return "", fmt.Errorf("could not parse GetExternalIPAddress response: %s", err)
+	}
+	return res.IP, nil
+}
@@ -0,0 +1,276 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/lease"
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+var protocols = []string{"TCP", "UDP"}
+
+// Opens ports on a router with UPnP IGD, for home setups without a VPN.
+// As a port source it maps an external port and reports it, as a pusher it opens the port it is given.
+// Mappings are renewed half way through their lease.
+type Client struct {
+	location       string // device description URL, discovered over SSDP when empty
+	ssdpAddr       string
+	timeout        time.Duration
+	internalClient string // LAN address the router forwards to, this host when empty
+	externalPort   int    // port to request as a source, 0 picks a random one
+	lease          time.Duration
+	description    string
+	tries          int
+	client         *http.Client
+	Log            logging.Logger
+	mu             sync.Mutex
+	control        string
+	serviceType    string
+	mapped         int // current mapped port, 0 when there is no mapping
+	renewer        *lease.Renewer
+}
+
+// Stringer
+func (c *Client) String() string {
+	location := c.location
+	if location == "" {
+		location = "discover"
+	}
+	internalClient := c.internalClient
+	if internalClient == "" {
+		internalClient = "auto"
+	}
+	return fmt.Sprintf("location=%s internal_client=%s external_port=%d lease=%v", location, internalClient, c.externalPort, c.lease)
+}
+
+func NewClient(location string, internalClient string, leaseTime time.Duration, httpClient *http.Client, logger logging.Logger) *Client {
+	logger = &logging.PrefixLogger{Log: logger, Prefix: "upnp: "}
+	c := &Client{
+		location:       location,
+		ssdpAddr:       ssdpMulticast,
+		timeout:        3 * time.Second,
+		internalClient: internalClient,
+		lease:          leaseTime,
+		description:    "PortPusher",
+		tries:          8,
+		client:         httpClient,
+		Log:            logger,
+	}
+	c.renewer = lease.NewRenewer(c.renew, logger)
+	return c
+}
+
+// External port to ask the router for when used as a port source
+func (c *Client) SetExternalPort(port int) {
+	c.externalPort = port
+}
+
+// Pull the mapped port from the router.
+// A mapping is only requested when there is no unexpired lease, renewals happen in the background.
+func (c *Client) PullPorts() ([]int, error) {
+	port, err := c.doPullPort()
+	if err != nil {
+		c.Log.Error("pull port error: %v", err)
+		return nil, err
+	}
+	return []int{port}, nil
+}
+
+func (c *Client) doPullPort() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.valid() {
+		c.Log.Info("Forwarded port is %d", c.mapped)
+		return c.mapped, nil
+	}
+	port := c.mapped
+	if port == 0 {
+		port = c.externalPort
+	}
+	if err := c.mapPort(port); err != nil {
+		return -1, err
+	}
+	c.Log.Info("Forwarded port is %d", c.mapped)
+	return c.mapped, nil
+}
+
+// Push a port by opening it on the router
+func (c *Client) Push(port int) error {
+	err := c.doPush(port)
+	if err != nil {
+		c.Log.Error("push port error: %v", err)
+	}
+	return err
+}
+
+func (c *Client) doPush(port int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if port == c.mapped && c.valid() {
+		c.Log.Info("Port mapping is correct")
+		return nil
+	}
+	old := c.mapped
+	if err := c.mapPort(port); err != nil {
+		return err
+	}
+	if old != 0 && old != port {
+		c.unmap(old)
+	}
+	c.Log.Info("Port %d opened", port)
+	return nil
+}
+
+// Stops renewing the mapping
+func (c *Client) Close() {
+	c.renewer.Close()
+}
+
+// Whether the current mapping is still leased. Must hold c.mu.
+func (c *Client) valid() bool {
+	return c.mapped != 0 && c.renewer.Valid()
+}
+
+// Finds the router's WAN connection service. Must hold c.mu.
+func (c *Client) connect() error {
+	if c.control != "" {
+		return nil
+	}
+	location := c.location
+	if location == "" {
+		var err error
+		location, err = discover(c.ssdpAddr, c.timeout)
+		if err != nil {
+			return err
+		}
+		c.Log.Debug("Discovered gateway at %s", location)
+	}
+
+	res, err := c.client.Get(location)
+	if err != nil {
+		return fmt.Errorf("failed to fetch device description: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch device description. HTTP status: %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response %s", err)
+	}
+	control, serviceType, err := parseDescription(data, location)
+	if err != nil {
+		return err
+	}
+
+	if c.internalClient == "" {
+		// the address this host uses to reach the router
+		u, err := url.Parse(control)
+		if err != nil {
+			return err
+		}
+		conn, err := net.Dial("udp4", u.Host)
+		if err != nil {
+			return fmt.Errorf("cannot find the local address: %w", err)
+		}
+		c.internalClient = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+	}
+
+	c.control = control
+	c.serviceType = serviceType
+	c.Log.Info("Found %s at %s, mapping to %s", serviceType, control, c.internalClient)
+	if ip, err := c.getExternalIPAddress(); err != nil {
+		c.Log.Warn("could not get the external IP: %v", err)
+	} else {
+		c.Log.Info("External IP is %s", ip)
+	}
+	return nil
+}
+
+// Maps port for TCP and UDP and schedules the renewal, a random port is picked when port is 0. Must hold c.mu.
+func (c *Client) mapPort(port int) error {
+	if err := c.connect(); err != nil {
+		// the router may have restarted with a new description URL
+		c.control = ""
+		return err
+	}
+
+	random := port == 0
+	for try := 1; ; try++ {
+		if random {
+			port = 49152 + rand.Intn(16384)
+		}
+		err := c.add(port)
+		var se *SOAPError
+		if random && errors.As(err, &se) && se.Code == codeConflict && try < c.tries {
+			c.Log.Debug("port %d is taken, trying another", port)
+			continue
+		}
+		if err != nil {
+			c.control = ""
+			return err
+		}
+		break
+	}
+
+	if c.mapped != 0 && c.mapped != port {
+		c.Log.Info("Forwarded port changed from %d to %d", c.mapped, port)
+	}
+	c.mapped = port
+	// a lease of 0 is permanent and isn't renewed
+	c.renewer.Granted(c.lease)
+	return nil
+}
+
+// Adds the TCP and UDP mappings of a port. When one fails the ones already added are removed,
+// so a failed try doesn't leave a stray forward on the router. Must hold c.mu.
+func (c *Client) add(port int) error {
+	for i, protocol := range protocols {
+		err := c.addPortMapping(port, protocol, c.lease)
+		var se *SOAPError
+		if errors.As(err, &se) && se.Code == codePermanentOnly && c.lease > 0 {
+			c.Log.Warn("Router only supports permanent mappings, they won't be renewed")
+			c.lease = 0
+			err = c.addPortMapping(port, protocol, 0)
+		}
+		if err != nil {
+			for _, added := range protocols[:i] {
+				if err := c.deletePortMapping(port, added); err != nil {
+					c.Log.Warn("could not remove the %s mapping of port %d: %v", added, port, err)
+				}
+			}
+			return fmt.Errorf("%s mapping of port %d failed: %w", protocol, port, err)
+		}
+	}
+	return nil
+}
+
+// Removes the mappings of a port that's no longer used. Must hold c.mu.
+func (c *Client) unmap(port int) {
+	for _, protocol := range protocols {
+		if err := c.deletePortMapping(port, protocol); err != nil {
+			c.Log.Warn("could not remove the %s mapping of port %d: %v", protocol, port, err)
+		}
+	}
+}
+
+func (c *Client) renew() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.mapPort(c.mapped); err != nil {
+		return err
+	}
+	c.Log.Debug("Renewed port %d until %v", c.mapped, c.renewer.Expires().Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,374 @@
+package upnp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanreh/portpusher/internal/logging"
+)
+
+const testDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+type mapping struct {
+	port     string
+	protocol string
+	client   string
+	lease    string
+}
+
+// In-process Internet gateway: an SSDP responder and a SOAP control endpoint
+type fakeIGD struct {
+	ssdp      *net.UDPConn
+	server    *httptest.Server
+	mu        sync.Mutex
+	mappings  map[string]mapping // by port/protocol
+	taken     map[string]bool    // ports mapped by someone else
+	permanent bool               // only accept lease 0
+	udpTaken  bool               // every UDP port is mapped by someone else
+	deletes   []string
+	searches  int
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	g := &fakeIGD{mappings: map[string]mapping{}, taken: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", g.control)
+	g.server = httptest.NewServer(mux)
+	t.Cleanup(g.server.Close)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.ssdp = conn
+	t.Cleanup(func() { conn.Close() })
+	go g.serveSSDP()
+	return g
+}
+
+func (g *fakeIGD) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := g.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := string(buf[:n])
+		if !strings.HasPrefix(req, "M-SEARCH") || !strings.Contains(req, "InternetGatewayDevice:1") {
+			continue
+		}
+		g.mu.Lock()
+		g.searches++
+		g.mu.Unlock()
+		res := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=120\r\n" +
+			"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			"LOCATION: " + g.server.URL + "/rootDesc.xml\r\n\r\n"
+		g.ssdp.WriteToUDP([]byte(res), addr)
+	}
+}
+
+func (g *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	var env struct {
+		Body struct {
+			Action struct {
+				XMLName  xml.Name
+				Port     string `xml:"NewExternalPort"`
+				Protocol string `xml:"NewProtocol"`
+				Client   string `xml:"NewInternalClient"`
+				Lease    string `xml:"NewLeaseDuration"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := env.Body.Action
+	if r.Header.Get("SOAPAction") != `"urn:schemas-upnp-org:service:WANIPConnection:1#`+action.XMLName.Local+`"` {
+		http.Error(w, "bad SOAPAction "+r.Header.Get("SOAPAction"), http.StatusBadRequest)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := action.Port + "/" + action.Protocol
+	switch action.XMLName.Local {
+	case "GetExternalIPAddress":
+		respond(w, "GetExternalIPAddress", "<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>")
+	case "AddPortMapping":
+		if g.taken[action.Port] || (g.udpTaken && action.Protocol == "UDP") {
+			fault(w, 718, "ConflictInMappingEntry")
+			return
+		}
+		if g.permanent && action.Lease != "0" {
+			fault(w, 725, "OnlyPermanentLeasesSupported")
+			return
+		}
+		g.mappings[key] = mapping{port: action.Port, protocol: action.Protocol, client: action.Client, lease: action.Lease}
+		respond(w, "AddPortMapping", "")
+	case "DeletePortMapping":
+		if _, ok := g.mappings[key]; !ok {
+			fault(w, 714, "NoSuchEntryInArray")
+			return
+		}
+		delete(g.mappings, key)
+		g.deletes = append(g.deletes, key)
+		respond(w, "DeletePortMapping", "")
+	default:
+		fault(w, 401, "Invalid Action")
+	}
+}
+
+func respond(w http.ResponseWriter, action string, inner string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`, action, inner, action)
+}
+
+func fault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, description)
+}
+
+func (g *fakeIGD) get(port int, protocol string) (mapping, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, ok := g.mappings[fmt.Sprintf("%d/%s", port, protocol)]
+	return m, ok
+}
+
+func (g *fakeIGD) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.mappings)
+}
+
+func (g *fakeIGD) discoveries() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.searches
+}
+
+func newTestClient(g *fakeIGD, lease time.Duration) *Client {
+	c := NewClient("", "", lease, http.DefaultClient, logging.NewLogger(logging.ERROR))
+	c.ssdpAddr = g.ssdp.LocalAddr().String()
+	c.timeout = time.Second
+	return c
+}
+
+func TestPullPortsDiscoversAndMaps(t *testing.T) {
+	g := newFakeIGD(t)
+	c := newTestClient(g, time.Hour)
+	c.SetExternalPort(44201)
+	defer c.Close()
+
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(ports) != 1 || ports[0] != 44201 {
+		t.Fatalf("Expected port 44201, got %v", ports)
+	}
+	for _, protocol := range protocols {
+		m, ok := g.get(44201, protocol)
+		if !ok {
+			t.Fatalf("Expected a %s mapping", protocol)
+		}
+		if m.client != "127.0.0.1" || m.lease != "3600" {
+			t.Errorf("Expected a 3600s mapping to 127.0.0.1, got %+v", m)
+		}
+	}
+
+	// the lease is still valid, nothing is requested
+	c.PullPorts()
+	if n := g.discoveries(); n != 1 {
+		t.Errorf("Expected one discovery, got %d", n)
+	}
+}
+
+func TestPullPortsRandomPortAvoidsConflicts(t *testing.T) {
+	g := newFakeIGD(t)
+	g.mu.Lock()
+	for p := 49152; p < 65536; p++ {
+		if p%2 == 0 {
+			g.taken[fmt.Sprint(p)] = true
+		}
+	}
+	g.mu.Unlock()
+	c := newTestClient(g, time.Hour)
+	c.tries = 100
+	defer c.Close()
+
+	ports, err := c.PullPorts()
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if ports[0] < 49152 || ports[0]%2 == 0 {
+		t.Errorf("Expected a free dynamic port, got %d", ports[0])
+	}
+	if _, ok := g.get(ports[0], "UDP"); !ok {
+		t.Errorf("Expected port %d to be mapped", ports[0])
+	}
+}
+
+func TestFailedMappingIsRemoved(t *testing.T) {
+	g := newFakeIGD(t)
+	g.mu.Lock()
+	g.udpTaken = true
+	g.mu.Unlock()
+	c := newTestClient(g, time.Hour)
+	defer c.Close()
+
+	if _, err := c.PullPorts(); err == nil {
+		t.Fatalf("Expected error when every UDP port is taken")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.mappings) != 0 {
+		t.Errorf("Expected no mappings left, got %v", g.mappings)
+	}
+	if len(g.deletes) != c.tries {
+		t.Errorf("Expected the TCP mapping of each of the %d tries to be removed, got %v", c.tries, g.deletes)
+	}
+	for _, key := range g.deletes {
+		if !strings.HasSuffix(key, "/TCP") {
+			t.Errorf("Expected only TCP mappings to be removed, got %s", key)
+		}
+	}
+}
+
+func TestPermanentLeaseFallback(t *testing.T) {
+	g := newFakeIGD(t)
+	g.mu.Lock()
+	g.permanent = true
+	g.mu.Unlock()
+	c := newTestClient(g, time.Hour)
+	c.SetExternalPort(44201)
+	defer c.Close()
+
+	if _, err := c.PullPorts(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	m, _ := g.get(44201, "TCP")
+	if m.lease != "0" {
+		t.Errorf("Expected a permanent mapping, got lease %s", m.lease)
+	}
+	if !c.renewer.Expires().IsZero() {
+		t.Errorf("Expected no renewal for a permanent mapping")
+	}
+}
+
+func TestRenewal(t *testing.T) {
+	g := newFakeIGD(t)
+	c := newTestClient(g, 2*time.Second)
+	c.SetExternalPort(44201)
+	defer c.Close()
+
+	if _, err := c.PullPorts(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	g.mu.Lock()
+	g.mappings = map[string]mapping{}
+	g.mu.Unlock()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for g.count() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the mapping to be renewed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPushOpensPortAndRemovesOld(t *testing.T) {
+	g := newFakeIGD(t)
+	c := NewClient(g.server.URL+"/rootDesc.xml", "192.168.1.20", time.Hour, http.DefaultClient, logging.NewLogger(logging.ERROR))
+	defer c.Close()
+
+	if err := c.Push(44201); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	m, ok := g.get(44201, "TCP")
+	if !ok || m.client != "192.168.1.20" {
+		t.Fatalf("Expected port 44201 mapped to 192.168.1.20, got %+v", m)
+	}
+	if n := g.discoveries(); n != 0 {
+		t.Errorf("Expected no discovery with a description URL, got %d", n)
+	}
+
+	if err := c.Push(44202); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if _, ok := g.get(44201, "TCP"); ok {
+		t.Errorf("Expected the old mapping to be removed")
+	}
+	if g.count() != 2 {
+		t.Errorf("Expected 2 mappings, got %d", g.count())
+	}
+}
+
+func TestPushConflict(t *testing.T) {
+	g := newFakeIGD(t)
+	g.mu.Lock()
+	g.taken["44201"] = true
+	g.mu.Unlock()
+	c := NewClient(g.server.URL+"/rootDesc.xml", "192.168.1.20", time.Hour, http.DefaultClient, logging.NewLogger(logging.ERROR))
+	defer c.Close()
+
+	err := c.Push(44201)
+	var se *SOAPError
+	if !errors.As(err, &se) || se.Code != 718 {
+		t.Errorf("Expected UPnP error 718, got %v", err)
+	}
+}
+
+func TestParseDescription(t *testing.T) {
+	control, serviceType, err := parseDescription([]byte(testDescription), "http://192.168.1.1:5000/rootDesc.xml")
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if control != "http://192.168.1.1:5000/ctl/IPConn" {
+		t.Errorf("Unexpected control URL %s", control)
+	}
+	if serviceType != "urn:schemas-upnp-org:service:WANIPConnection:1" {
+		t.Errorf("Unexpected service type %s", serviceType)
+	}
+
+	if _, _, err := parseDescription([]byte(`<root><device></device></root>`), "http://192.168.1.1/"); err == nil {
+		t.Errorf("Expected an error without a WAN connection service")
+	}
+}
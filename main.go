@@ -4,17 +4,58 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/cookiejar"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/nanreh/portpusher/internal/env"
-	"github.com/nanreh/portpusher/internal/gluetun"
 	"github.com/nanreh/portpusher/internal/logging"
+	"github.com/nanreh/portpusher/internal/ports"
+	"github.com/nanreh/portpusher/internal/source"
 )
 
 type PortPusher interface {
 	Push(int) error
 }
 
+// Implemented by sources that know the VPN public IP
+type IPSource interface {
+	PullPublicIP() (*source.PublicIP, error)
+}
+
+// Implemented by clients that can announce the VPN public IP to trackers
+type IPPusher interface {
+	PushIP(string) error
+}
+
+// Implemented by clients that hold a session or a mapping to release when PortPusher stops
+type Closer interface {
+	Close()
+}
+
+// A configured client and the forwarded port it should get
+type target struct {
+	name     string
+	pusher   PortPusher
+	mapping  ports.Mapping
+	ipPusher IPPusher // nil unless the client opted in to announce IP updates
+	tunnel   string   // name of the tunnel whose port it gets
+}
+
+// The port sources of one VPN tunnel and the clients that get its port
+type tunnel struct {
+	name     string
+	log      logging.Logger
+	chain    *source.Chain
+	ipSource IPSource // first source that knows the public IP, if any
+	targets  []target
+	// minutes between pushes, PUSHER_DELAY_SUCCESS and PUSHER_DELAY_ERROR or the tunnel's own
+	delaySuccess time.Duration
+	delayError   time.Duration
+}
+
 func main() {
 	logLevel, err := env.GetLogLevel()
 	if err != nil {
@@ -23,91 +64,339 @@ func main() {
 	}
 	logger := logging.NewLogger(logLevel)
 
-	delayError, err := env.GetDelayError()
+	tunnelNames, err := env.GetTunnels()
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("%v", err)
 		return
 	}
 
-	delaySuccess, err := env.GetDelaySuccess()
+	targets := make([]target, 0, 3)
+
+	targets, err = addTargets(targets, env.Transmission, env.GetTransmissionClient, tunnelNames, logger)
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("Error building Transmission client: %v", err)
 		return
 	}
 
-	jar, err := cookiejar.New(nil)
-	if nil != err {
-		fmt.Printf("%s\n", err)
+	targets, err = addTargets(targets, env.Qbittorrent, env.GetQbittorrentClient, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building QBittorrent client: %v", err)
 		return
 	}
-	httpClient := &http.Client{
-		Jar: jar,
+
+	targets, err = addTargets(targets, env.Deluge, env.GetDelugeClient, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building Deluge client: %v", err)
+		return
 	}
 
-	gtc, err := env.GetGluetunClient(httpClient, logger)
+	targets, err = addTargets(targets, env.Rtorrent, env.GetRtorrentClient, tunnelNames, logger)
 	if err != nil {
-		logger.Error("Error building Gluetun client: %v", err)
+		logger.Error("Error building rTorrent client: %v", err)
 		return
 	}
 
-	pushers := make([]PortPusher, 0, 3)
+	targets, err = addTargets(targets, env.Aria2, env.GetAria2Client, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building aria2 client: %v", err)
+		return
+	}
 
-	tc, err := env.GetTransmissionClient(httpClient, logger)
+	targets, err = addTargets(targets, env.Flood, env.GetFloodClient, tunnelNames, logger)
 	if err != nil {
-		logger.Error("Error building Transmission client: %v", err)
+		logger.Error("Error building Flood client: %v", err)
 		return
-	} else if tc != nil {
-		pushers = append(pushers, tc)
 	}
 
-	qbt, err := env.GetQbittorrentClient(httpClient, logger)
+	targets, err = addTargets(targets, env.Slskd, env.GetSlskdClient, tunnelNames, logger)
 	if err != nil {
-		logger.Error("Error building QBittorrent client: %v", err)
+		logger.Error("Error building slskd client: %v", err)
 		return
-	} else if qbt != nil {
-		pushers = append(pushers, qbt)
 	}
 
-	dc, err := env.GetDelugeClient(httpClient, logger)
+	targets, err = addTargets(targets, env.Syncthing, env.GetSyncthingClient, tunnelNames, logger)
 	if err != nil {
-		logger.Error("Error building Deluge client: %v", err)
+		logger.Error("Error building Syncthing client: %v", err)
+		return
+	}
+
+	targets, err = addTargets(targets, env.Plex, env.GetPlexClient, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building Plex client: %v", err)
+		return
+	}
+
+	targets, err = addTargets(targets, env.Tribler, env.GetTriblerClient, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building Tribler client: %v", err)
+		return
+	}
+
+	targets, err = addTargets(targets, env.Synology, env.GetSynologyClient, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building Synology Download Station client: %v", err)
+		return
+	}
+
+	targets, err = addTargets(targets, env.Kubo, env.GetKuboClient, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building Kubo client: %v", err)
+		return
+	}
+
+	targets, err = addTargets(targets, env.Amule, env.GetAmuleClient, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building aMule client: %v", err)
+		return
+	}
+
+	targets, err = addTargets(targets, env.Upnp, env.GetUpnpSink, tunnelNames, logger)
+	if err != nil {
+		logger.Error("Error building UPnP router client: %v", err)
 		return
-	} else if dc != nil {
-		pushers = append(pushers, dc)
 	}
 
-	if len(pushers) == 0 {
+	if len(targets) == 0 {
 		logger.Error("No bittorrent clients are configured, nothing to do")
 		return
 	}
 
-	loop(logger, gtc, pushers, delaySuccess, delayError)
+	tunnels := make([]*tunnel, 0, len(tunnelNames))
+	for _, name := range tunnelNames {
+		members := make([]target, 0, len(targets))
+		for _, t := range targets {
+			if t.tunnel == name {
+				members = append(members, t)
+			}
+		}
+		if len(members) == 0 {
+			logger.Warn("No clients use tunnel %s, ignoring it", name)
+			continue
+		}
+		t, err := newTunnel(name, members, logger)
+		if err != nil {
+			logger.Error("Error building port sources: %v", err)
+			return
+		}
+		tunnels = append(tunnels, t)
+	}
+
+	// every tunnel runs on its own schedule, a failing tunnel doesn't hold up the others
+	for _, t := range tunnels {
+		go t.loop()
+	}
+
+	// on docker stop or Ctrl-C, clients with a session log out
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("Got %v, stopping", <-stop)
+	for _, t := range targets {
+		if c, ok := t.pusher.(Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// Builds the source chain of a tunnel, named tunnels log with their name so they can be told apart
+func newTunnel(name string, targets []target, logger logging.Logger) (*tunnel, error) {
+	if name != "" {
+		logger = &logging.PrefixLogger{Log: logger, Prefix: "[" + name + "] "}
+	}
+
+	sourceNames, err := env.GetSources(name)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff, err := env.GetSourceBackoff(name)
+	if err != nil {
+		return nil, err
+	}
+
+	delaySuccess, err := env.GetDelaySuccess(name)
+	if err != nil {
+		return nil, err
+	}
+
+	delayError, err := env.GetDelayError(name)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tunnel{
+		name:         name,
+		log:          logger,
+		chain:        source.NewChain(backoff, logger),
+		targets:      targets,
+		delaySuccess: delaySuccess,
+		delayError:   delayError,
+	}
+	// the sources of a tunnel share cookies, never with another tunnel's or a client's
+	httpClient := newHTTPClient()
+	for _, sourceName := range sourceNames {
+		s, err := buildSource(name, sourceName, httpClient, logger)
+		if err != nil {
+			return nil, fmt.Errorf("%s source: %w", sourceName, err)
+		}
+		t.chain.Add(sourceName, s)
+		if is, ok := s.(IPSource); ok && t.ipSource == nil {
+			t.ipSource = is
+		}
+	}
+	if len(sourceNames) > 1 {
+		t.chain.Log.Info("Chain ready %s", t.chain)
+	}
+
+	for _, target := range targets {
+		if target.ipPusher != nil && t.ipSource == nil {
+			return nil, fmt.Errorf("%s: announce IP needs a port source that reports the public IP, %s does not", target.name, strings.Join(sourceNames, ", "))
+		}
+	}
+	return t, nil
+}
+
+// Builds one port source of a tunnel from its env configuration
+func buildSource(tunnel string, name string, httpClient *http.Client, logger logging.Logger) (source.Source, error) {
+	switch name {
+	case env.SourceGluetun:
+		gtc, err := env.GetGluetunClient(tunnel, httpClient, logger)
+		if err != nil {
+			return nil, err
+		}
+		remediator, err := env.GetGluetunRemediator(tunnel, gtc, logger)
+		if err != nil {
+			return nil, fmt.Errorf("restart policy: %w", err)
+		}
+		if remediator != nil {
+			gtc.SetRemediator(remediator)
+		}
+		return gtc, nil
+	case env.SourceNatpmp:
+		return env.GetNatpmpClient(tunnel, logger)
+	case env.SourcePcp:
+		return env.GetPcpClient(tunnel, logger)
+	case env.SourcePia:
+		return env.GetPiaClient(tunnel, logger)
+	case env.SourceFile:
+		return env.GetFileClient(tunnel, logger)
+	case env.SourceHTTP:
+		return env.GetHTTPClient(tunnel, httpClient, logger)
+	case env.SourceExec:
+		return env.GetExecClient(tunnel, logger)
+	case env.SourceUpnp:
+		return env.GetUpnpClient(tunnel, httpClient, logger)
+	default:
+		return nil, fmt.Errorf("unknown source %s", name)
+	}
+}
+
+// Builds every configured instance of a client, e.g. QBITTORRENT, QBITTORRENT2, ...
+// Instances that aren't enabled are skipped. Every instance gets its own cookie jar, cookies are kept by host
+// and instances on the same host would overwrite each other's session.
+func addTargets[T interface {
+	comparable
+	PortPusher
+}](targets []target, name string, build func(string, *http.Client, logging.Logger) (T, error), tunnels []string, logger logging.Logger) ([]target, error) {
+	var disabled T
+	for _, instance := range env.Instances(name) {
+		c, err := build(instance, newHTTPClient(), logger)
+		if err != nil {
+			return targets, err
+		}
+		if c == disabled {
+			continue
+		}
+		mapping, err := env.GetPortMapping(instance)
+		if err != nil {
+			return targets, err
+		}
+		tunnel, err := env.GetTunnel(instance, tunnels)
+		if err != nil {
+			return targets, err
+		}
+		t := target{name: strings.ToLower(instance), pusher: c, mapping: mapping, tunnel: tunnel}
+		if env.GetAnnounceIP(instance) {
+			ipPusher, ok := any(c).(IPPusher)
+			if !ok {
+				return targets, fmt.Errorf("%s does not support setting an announce IP", t.name)
+			}
+			t.ipPusher = ipPusher
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// An HTTP client with its own cookie jar
+func newHTTPClient() *http.Client {
+	// cookiejar.New only fails on a bad public suffix list
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar: jar,
+	}
 }
 
-func loop(logger logging.Logger, gtc *gluetun.Client, pushers []PortPusher, delaySuccess time.Duration, delayError time.Duration) {
+func (tn *tunnel) loop() {
 	for {
-		logger.Info("Running...")
-		// fetch forwarded port
-		port, err := gtc.PullPort()
+		tn.log.Info("Running...")
+		// fetch forwarded ports
+		forwarded, err := tn.chain.PullPorts()
 		if err != nil {
-			logger.Info("Done. Next push attempt in %v.", delayError)
-			time.Sleep(delayError)
+			tn.log.Info("Done. Next push attempt in %v.", tn.delayError)
+			tn.wait(tn.delayError)
 		} else {
 			isError := false
-			for _, p := range pushers {
+			// fetch the public IP only when a client wants it
+			var publicIP *source.PublicIP
+			var ipErr error
+			for _, t := range tn.targets {
+				if t.ipPusher != nil {
+					publicIP, ipErr = tn.ipSource.PullPublicIP()
+					if ipErr != nil {
+						tn.log.Error("cannot get the public IP, not announcing it: %v", ipErr)
+					}
+					break
+				}
+			}
+			for _, t := range tn.targets {
+				port, err := t.mapping.Select(forwarded)
+				if err != nil {
+					tn.log.Error("%s: cannot pick a forwarded port: %v", t.name, err)
+					isError = true
+					continue
+				}
 				// push forwarded port
-				err = p.Push(port)
+				err = t.pusher.Push(port)
 				if err != nil {
 					isError = true
 				}
+				if t.ipPusher != nil {
+					if ipErr != nil {
+						isError = true
+					} else if err := t.ipPusher.PushIP(publicIP.IP); err != nil {
+						tn.log.Error("%s: cannot announce IP %s: %v", t.name, publicIP.IP, err)
+						isError = true
+					}
+				}
 			}
 			if isError {
-				logger.Info("Done. Next push attempt in %v.", delayError)
-				time.Sleep(delayError)
+				tn.log.Info("Done, port from %s. Next push attempt in %v.", tn.chain.Last(), tn.delayError)
+				tn.wait(tn.delayError)
 			} else {
-				logger.Info("Done. Next push in %v.", delaySuccess)
-				time.Sleep(delaySuccess)
+				tn.log.Info("Done, port from %s. Next push in %v.", tn.chain.Last(), tn.delaySuccess)
+				tn.wait(tn.delaySuccess)
 			}
 		}
 	}
 }
+
+// Sleeps until the next push, or until a source reports that the port changed
+func (tn *tunnel) wait(delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-tn.chain.Changes():
+		tn.log.Info("Port changed, pushing now.")
+	}
+}